@@ -0,0 +1,72 @@
+// Package analyzer parses Bitrise build logs into steps and reduces them to what matters for analyzing
+// a failure. It is the log processing of the AI build issue analyzer step, without the Bitrise API and
+// the step inputs, so other steps and tools can reuse it.
+package analyzer
+
+// Options configures Optimize, DefaultOptions are the defaults of the step
+type Options struct {
+	// Patterns are the step log filter patterns, e.g. DefaultFilterPatterns, no filtering when empty
+	Patterns string
+	Filter   FilterOptions
+	// TailLines keeps the last lines of each step, 0 keeps all lines
+	TailLines int
+	// CollapseRepeats keeps one copy of identical multi-line blocks of a step, e.g. stack traces
+	CollapseRepeats bool
+	// MaxTokens truncates the logs to roughly this many tokens, 0 disables truncation
+	MaxTokens int
+	// FailedSteps are the titles of the failed steps, kept first when truncating
+	FailedSteps []string
+	// KeepANSI keeps the escape codes, e.g. when the logs were already cleaned as configured
+	KeepANSI bool
+	// StepFilter replaces the filtering by Patterns and TailLines, e.g. to filter by more than the step type.
+	// It returns the reduced logs of the step, and false to drop the step.
+	StepFilter func(StepLogs) (string, bool)
+	// Reorder rearranges the filtered logs before the repeated blocks are collapsed, e.g. into time order
+	Reorder func(string) string
+}
+
+// DefaultOptions returns the options of the step with its inputs left at their defaults.
+func DefaultOptions() Options {
+	return Options{
+		Filter:          DefaultFilterOptions(),
+		CollapseRepeats: true,
+	}
+}
+
+// Optimize cleans the logs (invalid UTF-8, escape codes and progress bars) and reduces them step by step: filtering by the patterns of each step type,
+// keeping the tail of each step, collapsing repeated blocks and truncating to the token budget, in that order.
+func Optimize(logs string, opts Options) string {
+	logs = SanitizeUTF8(logs)
+	if !opts.KeepANSI {
+		logs = StripANSI(logs)
+	}
+
+	stepFilter := opts.StepFilter
+	if stepFilter == nil {
+		stepFilter = func(step StepLogs) (string, bool) {
+			stepLogs := step.Logs
+			if opts.Patterns != "" {
+				stepLogs = filterStep(step, opts.Patterns, opts.Filter)
+			}
+			return TailStepLines(stepLogs, opts.TailLines), true
+		}
+	}
+
+	steps := ParseSteps(CollapseCarriageReturns(logs))
+	reduced := make([]string, 0, len(steps))
+	for _, step := range steps {
+		if stepLogs, kept := stepFilter(step); kept {
+			reduced = append(reduced, stepLogs)
+		}
+	}
+	optimized := JoinStepLogs(reduced)
+
+	if opts.Reorder != nil {
+		optimized = opts.Reorder(optimized)
+	}
+	if opts.CollapseRepeats {
+		optimized = CollapseRepeatedBlocks(optimized)
+	}
+
+	return TruncateToTokenBudget(optimized, opts.MaxTokens, opts.FailedSteps)
+}
@@ -0,0 +1,162 @@
+package analyzer
+
+import (
+	"strings"
+	"testing"
+)
+
+const testBuildLog = `+------------------------------------------------------------------------------+
+| (0) Git Clone Repository                                                     |
++------------------------------------------------------------------------------+
+Cloning into repo
+Checked out main
++------------------------------------------------------------------------------+
+| (1) Xcode Test for iOS                                                       |
++------------------------------------------------------------------------------+
+Compiling AppDelegate.swift
+Compiling ViewController.swift
+error: cannot find 'foo' in scope
+** TEST FAILED **
+`
+
+func TestFilterByPatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns string
+		want     []string
+		dropped  []string
+	}{
+		{
+			name:     "keeps the matching lines of typed steps",
+			patterns: "xcode: error:",
+			want:     []string{"error: cannot find 'foo' in scope", "Cloning into repo"},
+			dropped:  []string{"Compiling AppDelegate.swift", "** TEST FAILED **"},
+		},
+		{
+			name:     "drops the exclude keywords of a type",
+			patterns: "xcode!: Compiling",
+			want:     []string{"error: cannot find 'foo' in scope", "** TEST FAILED **"},
+			dropped:  []string{"Compiling AppDelegate.swift", "Compiling ViewController.swift"},
+		},
+		{
+			name:     "keeps steps without a type whole",
+			patterns: "android: gradle",
+			want:     []string{"Cloning into repo", "Compiling AppDelegate.swift", "** TEST FAILED **"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultFilterOptions()
+			opts.ContextLinesBefore, opts.ContextLinesAfter = 0, 0
+			filtered := FilterByPatterns(testBuildLog, tt.patterns, opts)
+
+			for _, line := range tt.want {
+				if !strings.Contains(filtered, line) {
+					t.Errorf("filtered logs miss %q:\n%s", line, filtered)
+				}
+			}
+			for _, line := range tt.dropped {
+				if strings.Contains(filtered, line) {
+					t.Errorf("filtered logs keep %q:\n%s", line, filtered)
+				}
+			}
+		})
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	repeatedTrace := "Exception: flaky\n    at Test.run\n    at Runner.main\n"
+	logsWithRepeats := testBuildLog + strings.Repeat(repeatedTrace, 3)
+
+	tests := []struct {
+		name    string
+		logs    string
+		opts    Options
+		want    []string
+		dropped []string
+	}{
+		{
+			name:    "cleans escape codes and progress bars",
+			logs:    "\x1b[31mred\x1b[0m\nprogress 10%\rprogress 100%\n",
+			opts:    DefaultOptions(),
+			want:    []string{"red\n", "progress 100%"},
+			dropped: []string{"\x1b[", "progress 10%"},
+		},
+		{
+			name: "keeps escape codes with KeepANSI",
+			logs: "\x1b[31mred\x1b[0m\n",
+			opts: Options{KeepANSI: true},
+			want: []string{"\x1b[31mred"},
+		},
+		{
+			name:    "keeps the tail of each step",
+			logs:    testBuildLog,
+			opts:    Options{TailLines: 1},
+			want:    []string{"Checked out main", "** TEST FAILED **"},
+			dropped: []string{"Cloning into repo", "Compiling AppDelegate.swift"},
+		},
+		{
+			name:    "collapses repeated blocks",
+			logs:    logsWithRepeats,
+			opts:    DefaultOptions(),
+			want:    []string{"(repeated 3 times)"},
+			dropped: []string{repeatedTrace + repeatedTrace},
+		},
+		{
+			name:    "keeps repeated blocks without CollapseRepeats",
+			logs:    logsWithRepeats,
+			opts:    Options{},
+			want:    []string{repeatedTrace + repeatedTrace + repeatedTrace},
+			dropped: []string{"(repeated"},
+		},
+		{
+			name:    "truncates to the token budget keeping the failed step",
+			logs:    testBuildLog,
+			opts:    Options{MaxTokens: 60, FailedSteps: []string{"Xcode Test for iOS"}},
+			want:    []string{TruncationNotePrefix, "** TEST FAILED **"},
+			dropped: []string{"Cloning into repo"},
+		},
+		{
+			name: "StepFilter replaces the patterns and can drop steps",
+			logs: testBuildLog,
+			opts: Options{
+				Patterns: "xcode: error:",
+				StepFilter: func(step StepLogs) (string, bool) {
+					return step.Logs, step.Title != "Git Clone Repository"
+				},
+			},
+			want:    []string{"Compiling AppDelegate.swift", "** TEST FAILED **"},
+			dropped: []string{"Cloning into repo"},
+		},
+		{
+			name: "Reorder rearranges the filtered logs",
+			logs: testBuildLog,
+			opts: Options{
+				CollapseRepeats: true,
+				Reorder: func(logs string) string {
+					return strings.ReplaceAll(logs, "Compiling", "Building")
+				},
+			},
+			want:    []string{"Building AppDelegate.swift"},
+			dropped: []string{"Compiling"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			optimized := Optimize(tt.logs, tt.opts)
+
+			for _, text := range tt.want {
+				if !strings.Contains(optimized, text) {
+					t.Errorf("optimized logs miss %q:\n%s", text, optimized)
+				}
+			}
+			for _, text := range tt.dropped {
+				if strings.Contains(optimized, text) {
+					t.Errorf("optimized logs keep %q:\n%s", text, optimized)
+				}
+			}
+		})
+	}
+}
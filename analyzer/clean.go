@@ -0,0 +1,54 @@
+package analyzer
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// ansiEscapePattern matches ANSI escape sequences: CSI sequences (SGR colors, cursor moves, line erases),
+// OSC sequences (e.g. window titles) and the remaining two-character escapes.
+var ansiEscapePattern = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// SanitizeUTF8 replaces invalid UTF-8 sequences, e.g. binary output or text in a legacy encoding, with the
+// Unicode replacement character, so splitting and matching the logs works on valid text and no raw bytes
+// reach the output files or the AI.
+func SanitizeUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	return strings.ToValidUTF8(s, string(utf8.RuneError))
+}
+
+// StripANSI removes ANSI escape sequences and normalizes CRLF line endings,
+// so colored output and progress bars don't leave garbage in the collected logs.
+func StripANSI(s string) string {
+	s = ansiEscapePattern.ReplaceAllString(s, "")
+	return strings.ReplaceAll(s, "\r\n", "\n")
+}
+
+// CollapseCarriageReturns keeps only the final state of lines that were redrawn using \r,
+// e.g. gradle and xcodebuild progress bars, instead of every intermediate state.
+func CollapseCarriageReturns(logs string) string {
+	if !strings.Contains(logs, "\r") {
+		return logs
+	}
+
+	lines := strings.Split(logs, "\n")
+	for i, line := range lines {
+		if !strings.Contains(line, "\r") {
+			continue
+		}
+
+		// The last non-empty segment is what remains visible on the terminal
+		segments := strings.Split(line, "\r")
+		lines[i] = ""
+		for j := len(segments) - 1; j >= 0; j-- {
+			if segments[j] != "" {
+				lines[i] = segments[j]
+				break
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
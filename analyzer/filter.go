@@ -0,0 +1,380 @@
+package analyzer
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultFilterPatterns are used when filtering is enabled but step_log_filter_patterns is empty.
+// The first type found in a step title wins, so the specific types come before the generic ones.
+// Short generic keywords are "re:" word matches, so "error" doesn't keep every "errorHandler" line.
+const DefaultFilterPatterns = `xcode: xcodebuild,error:,fatal error:,FAILED,BUILD FAILED,Compile,CompileSwift,Ld ,libtool,codesign,Code Signing Error,No signing certificate,provisioning profile,Test Case,Test Suite,ASSERT,XCTAssert
+android: gradlew,gradle,BUILD FAILED,FAILURE:,Task :,compileDebug,assembleDebug,re:\blint\b,re:\btest\b,Error:,Exception,keystore,apksigner
+git: CONFLICT,fatal:,Merge failed,refusing to merge,re:\bgit\b,checkout,re:\bfetch\b,re:\bmerge\b,rebase,unrelated histories,Auto-merging
+signing: codesign,Code Signing Error,No signing certificate,provisioning profile,certificate,keychain,entitlements,expired,re:\berror\b
+cocoapods: pod install,[!],Unable to find a specification,CocoaPods could not find,re:\berror\b,Errno
+npm: npm ERR!,ERESOLVE,ERR_,gyp,404,re:\berror\b
+yarn: re:\berror\b,Couldn't find,ERR_,404
+dependencies: Could not resolve,Unable to find,not found,conflict,re:\berror\b,failed
+test: FAIL,failed,Assert,Expected,Test Case,Tests run,panic,re:\berror\b
+build: error:,fatal,FAILED,failed,Exception,undefined,re:\berror\b`
+
+// titleMappingPrefix starts a pattern line mapping an exact step title to a step type, e.g. `@title "Run Unit Tests" = test`
+const titleMappingPrefix = "@title"
+
+var titleMappingPattern = regexp.MustCompile(`^@title\s+"([^"]+)"\s*=\s*([^\s!]+)$`)
+
+// DetectStepType returns the step type of the patterns matching the step title, e.g. "xcode" for
+// "Xcode Test for iOS", or "" when none matches. mode is one of the MatchMode values.
+func DetectStepType(stepTitle, patterns, mode string) string {
+	if stepTitle == "" {
+		return ""
+	}
+
+	stepLower := strings.ToLower(stepTitle)
+	lines := strings.Split(patterns, "\n")
+
+	// Explicit title mappings take precedence over matching the type in the title
+	for _, line := range lines {
+		if match := titleMappingPattern.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+			if strings.EqualFold(strings.TrimSpace(match[1]), strings.TrimSpace(stepTitle)) {
+				return match[2]
+			}
+		}
+	}
+
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), titleMappingPrefix) {
+			continue
+		}
+		if strings.Contains(line, ":") {
+			parts := strings.SplitN(line, ":", 2)
+			// Exclude lines like "test!: Downloading" also define the step type
+			stepType := strings.TrimSuffix(strings.TrimSpace(parts[0]), excludeTypeSuffix)
+			if stepType == "" {
+				continue
+			}
+
+			// Check if step title contains this type
+			if NewKeywordMatcher(stepType, mode)(stepLower) {
+				return stepType
+			}
+		}
+	}
+
+	return ""
+}
+
+const (
+	DefaultContextLinesBefore = 2
+	DefaultContextLinesAfter  = 4
+)
+
+// FilterOptions configures how the step logs are filtered by the patterns
+type FilterOptions struct {
+	// MatchMode is how step types and keywords are matched, MatchModeSubstring when empty
+	MatchMode string
+	// ContextLinesBefore and ContextLinesAfter are the lines kept around each matching line
+	ContextLinesBefore int
+	ContextLinesAfter  int
+	// DedupeLines drops the repeated identical lines of a step
+	DedupeLines bool
+	// Warnf receives the warnings, e.g. invalid regex keywords, they are discarded when nil
+	Warnf func(format string, args ...interface{})
+}
+
+// DefaultFilterOptions are the filter options of the step with its inputs left at their defaults.
+func DefaultFilterOptions() FilterOptions {
+	return FilterOptions{
+		MatchMode:          MatchModeSubstring,
+		ContextLinesBefore: DefaultContextLinesBefore,
+		ContextLinesAfter:  DefaultContextLinesAfter,
+	}
+}
+
+// regexKeywordPrefix marks a keyword that is matched as a regular expression instead of a substring
+const regexKeywordPrefix = "re:"
+
+// multilineRegexKeywordPrefix marks a regular expression matched against the whole text of the step with
+// the s flag, so . matches newlines, e.g. "mre:FAILURE:.*?What went wrong:\n.*", see compileMultilineMatchers
+const multilineRegexKeywordPrefix = "mre:"
+
+const (
+	MatchModeSubstring = "substring"
+	MatchModeWord      = "word"
+	MatchModeExact     = "exact"
+)
+
+// NewKeywordMatcher matches a plain keyword anywhere in the text (substring), only as a whole word (word),
+// or only against the whole trimmed text (exact), so short keywords like "test" don't match "latest".
+func NewKeywordMatcher(keyword, mode string) func(string) bool {
+	switch mode {
+	case MatchModeWord:
+		re := regexp.MustCompile(`(?:^|\W)` + regexp.QuoteMeta(keyword) + `(?:\W|$)`)
+		return re.MatchString
+	case MatchModeExact:
+		return func(text string) bool {
+			return strings.TrimSpace(text) == keyword
+		}
+	default:
+		return func(text string) bool {
+			return strings.Contains(text, keyword)
+		}
+	}
+}
+
+// compileKeywordMatchers turns filter keywords into line matchers using the given match mode. Keywords
+// prefixed with "re:" are compiled as regular expressions, invalid ones are reported to warnf and skipped.
+func compileKeywordMatchers(keywords []string, mode string, warnf func(format string, args ...interface{})) []func(string) bool {
+	var matchers []func(string) bool
+	for _, keyword := range keywords {
+		if keyword == "" || strings.HasPrefix(keyword, multilineRegexKeywordPrefix) {
+			continue
+		}
+
+		if strings.HasPrefix(keyword, regexKeywordPrefix) {
+			expr := strings.TrimSpace(strings.TrimPrefix(keyword, regexKeywordPrefix))
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				if warnf != nil {
+					warnf("Warning: skipping invalid regex pattern %q: %v\n", expr, err)
+				}
+				continue
+			}
+			matchers = append(matchers, re.MatchString)
+			continue
+		}
+
+		matchers = append(matchers, NewKeywordMatcher(keyword, mode))
+	}
+	return matchers
+}
+
+// compileMultilineMatchers compiles the keywords prefixed with "mre:" with the s flag. Invalid ones are
+// reported to warnf and skipped.
+func compileMultilineMatchers(keywords []string, warnf func(format string, args ...interface{})) []*regexp.Regexp {
+	var matchers []*regexp.Regexp
+	for _, keyword := range keywords {
+		if !strings.HasPrefix(keyword, multilineRegexKeywordPrefix) {
+			continue
+		}
+
+		expr := strings.TrimSpace(strings.TrimPrefix(keyword, multilineRegexKeywordPrefix))
+		re, err := regexp.Compile("(?s)" + expr)
+		if err != nil {
+			if warnf != nil {
+				warnf("Warning: skipping invalid multi-line regex pattern %q: %v\n", expr, err)
+			}
+			continue
+		}
+		matchers = append(matchers, re)
+	}
+	return matchers
+}
+
+// excludeTypeSuffix marks a patterns line listing keywords to drop for a step type, e.g. "test!: Downloading, Resolving"
+const excludeTypeSuffix = "!"
+
+// patternKeywords returns the comma-separated keywords of the patterns line for the given key, e.g. "xcode" or "xcode!".
+func patternKeywords(allPatterns, key string) []string {
+	lines := strings.Split(allPatterns, "\n")
+	var keywords []string
+
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), key+":") {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) == 2 {
+				keywordStr := strings.TrimSpace(parts[1])
+				keywords = strings.Split(keywordStr, ",")
+				// Trim whitespace from each keyword
+				for i, keyword := range keywords {
+					keywords[i] = strings.TrimSpace(keyword)
+				}
+				break
+			}
+		}
+	}
+	return keywords
+}
+
+func matchesAny(matchers []func(string) bool, line string) bool {
+	for _, matches := range matchers {
+		if matches(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterByPatterns filters the logs of each step by the patterns of its step type, detected from its title.
+// Steps without a type, or without keywords for their type, are kept whole.
+func FilterByPatterns(logs, patterns string, opts FilterOptions) string {
+	steps := ParseSteps(logs)
+	filtered := make([]string, 0, len(steps))
+	for _, step := range steps {
+		filtered = append(filtered, filterStep(step, patterns, opts))
+	}
+	return JoinStepLogs(filtered)
+}
+
+func filterStep(step StepLogs, patterns string, opts FilterOptions) string {
+	stepType := DetectStepType(step.Title, patterns, opts.MatchMode)
+	if stepType == "" {
+		return step.Logs
+	}
+	return WithStepResult(FilterStepLogs(step.Logs, stepType, patterns, opts), step)
+}
+
+// FilterStepLogs keeps the lines of a step matching the keywords of its step type, with their context,
+// and drops the lines matching the exclude keywords of the type (a "type!:" patterns line).
+func FilterStepLogs(stepLogs, stepType, allPatterns string, opts FilterOptions) string {
+	// Extract the keywords to keep and to drop for this step type
+	keywords := patternKeywords(allPatterns, stepType)
+	excludeKeywords := patternKeywords(allPatterns, stepType+excludeTypeSuffix)
+
+	if len(keywords) == 0 && len(excludeKeywords) == 0 {
+		return stepLogs
+	}
+
+	// Compile the keywords once for the whole step instead of per line
+	matchers := compileKeywordMatchers(keywords, opts.MatchMode, opts.Warnf)
+	multilineMatchers := compileMultilineMatchers(keywords, opts.Warnf)
+	excludeMatchers := compileKeywordMatchers(excludeKeywords, opts.MatchMode, opts.Warnf)
+
+	// Lines of context kept around each match, e.g. to capture full stack traces
+	linesBefore := maxInt(0, opts.ContextLinesBefore)
+	linesAfter := maxInt(0, opts.ContextLinesAfter)
+
+	// Apply filtering with these keywords, tracking included lines by index
+	// so identical lines at different positions are all kept
+	logLines := strings.Split(stepLogs, "\n")
+	included := make([]bool, len(logLines))
+	anyMatch := false
+
+	// includeLines keeps the lines first to last, with context around them
+	includeLines := func(first, last int) {
+		start := maxInt(0, first-linesBefore)
+		end := minInt(len(logLines), last+linesAfter+1)
+		for j := start; j < end; j++ {
+			included[j] = true
+		}
+		anyMatch = true
+	}
+
+	for i, line := range logLines {
+		if matchesAny(matchers, line) {
+			includeLines(i, i)
+		}
+	}
+
+	// Multi-line patterns keep every line of the matched region, e.g. an error block whose
+	// reason is a few lines below its header
+	if len(multilineMatchers) > 0 {
+		lineStarts := make([]int, len(logLines))
+		offset := 0
+		for i, line := range logLines {
+			lineStarts[i] = offset
+			offset += len(line) + 1
+		}
+		lineAt := func(offset int) int {
+			return sort.Search(len(lineStarts), func(i int) bool { return lineStarts[i] > offset }) - 1
+		}
+
+		for _, re := range multilineMatchers {
+			for _, loc := range re.FindAllStringIndex(stepLogs, -1) {
+				if loc[0] == loc[1] {
+					continue
+				}
+				// The end of a match is exclusive, a match ending with a newline ends on that line
+				includeLines(lineAt(loc[0]), lineAt(loc[1]-1))
+			}
+		}
+	}
+
+	// If no keywords matched (or there are only exclude keywords), keep the whole step
+	if !anyMatch {
+		for i := range included {
+			included[i] = true
+		}
+	}
+
+	dedupe := opts.DedupeLines
+	seen := make(map[string]bool)
+	var filtered []string
+	for i, keep := range included {
+		if !keep {
+			continue
+		}
+		// Noisy lines are dropped even inside the context of a match
+		if matchesAny(excludeMatchers, logLines[i]) {
+			continue
+		}
+		if dedupe {
+			if seen[logLines[i]] {
+				continue
+			}
+			seen[logLines[i]] = true
+		}
+		filtered = append(filtered, logLines[i])
+	}
+
+	return strings.Join(filtered, "\n")
+}
+
+// TailStepLines keeps the last maxLines lines of a step, after its title so the step stays recognizable.
+func TailStepLines(stepLogs string, maxLines int) string {
+	if maxLines <= 0 {
+		return stepLogs
+	}
+
+	lines := strings.Split(strings.TrimRight(stepLogs, "\n"), "\n")
+	headerEnd := 0
+	for i, line := range lines {
+		if IsStepTitleLine(line) {
+			headerEnd = i + 1
+			break
+		}
+	}
+
+	body := lines[headerEnd:]
+	if len(body) <= maxLines {
+		return stepLogs
+	}
+
+	kept := append([]string{}, lines[:headerEnd]...)
+	kept = append(kept, fmt.Sprintf("... %d earlier lines omitted ...", len(body)-maxLines))
+	kept = append(kept, body[len(body)-maxLines:]...)
+	return strings.Join(kept, "\n")
+}
+
+// TailOfText returns at most maxBytes from the end of text, starting at a line boundary when possible.
+func TailOfText(text string, maxBytes int) string {
+	if len(text) <= maxBytes {
+		return text
+	}
+	if maxBytes <= 0 {
+		return ""
+	}
+
+	tail := text[len(text)-maxBytes:]
+	if idx := strings.Index(tail, "\n"); idx != -1 && idx < len(tail)-1 {
+		return tail[idx+1:]
+	}
+	return strings.ToValidUTF8(tail, "")
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
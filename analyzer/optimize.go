@@ -0,0 +1,126 @@
+package analyzer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CollapseRepeatedBlocks keeps the first occurrence of identical multi-line blocks within each step,
+// noting how many times it was repeated. A block is a line followed by its indented continuation lines, like a stack trace.
+func CollapseRepeatedBlocks(logs string) string {
+	steps := ParseSteps(logs)
+	collapsed := make([]string, 0, len(steps))
+	for _, step := range steps {
+		collapsed = append(collapsed, collapseRepeatedBlocksOfStep(step.Logs))
+	}
+	return JoinStepLogs(collapsed)
+}
+
+func collapseRepeatedBlocksOfStep(stepLogs string) string {
+	lines := strings.Split(stepLogs, "\n")
+
+	var blocks []string
+	for i := 0; i < len(lines); {
+		end := i + 1
+		for end < len(lines) && isContinuationLine(lines[end]) {
+			end++
+		}
+		blocks = append(blocks, strings.Join(lines[i:end], "\n"))
+		i = end
+	}
+
+	counts := map[string]int{}
+	for _, block := range blocks {
+		if strings.Contains(block, "\n") {
+			counts[block]++
+		}
+	}
+
+	var kept []string
+	seen := map[string]bool{}
+	for _, block := range blocks {
+		count := counts[block]
+		if count <= 1 {
+			kept = append(kept, block)
+			continue
+		}
+		if seen[block] {
+			continue
+		}
+		seen[block] = true
+		kept = append(kept, block, fmt.Sprintf("    (repeated %d times)", count))
+	}
+	return strings.Join(kept, "\n")
+}
+
+// isContinuationLine reports whether a line continues the block above it, like the frames of a stack trace.
+func isContinuationLine(line string) bool {
+	return strings.TrimSpace(line) != "" && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t"))
+}
+
+// TruncationNotePrefix starts the note added to logs that were truncated to the token budget
+const TruncationNotePrefix = "=== LOGS TRUNCATED:"
+
+// CharsPerToken approximates how many characters of log text make up one LLM token
+const CharsPerToken = 4
+
+// EstimateTokens approximates the number of LLM tokens of text
+func EstimateTokens(text string) int {
+	return (len(text) + CharsPerToken - 1) / CharsPerToken
+}
+
+// TruncateToTokenBudget keeps the logs within roughly maxTokens tokens. The failed steps are kept first,
+// then the remaining budget goes to the other steps starting from the end of the log, where errors usually appear.
+// Each step keeps its tail when it doesn't fit completely. A maxTokens of 0 or less disables truncation.
+// failedSteps are the titles of the failed steps, matched with MatchesStepTitle.
+func TruncateToTokenBudget(logs string, maxTokens int, failedSteps []string) string {
+	if maxTokens <= 0 || EstimateTokens(logs) <= maxTokens {
+		return logs
+	}
+
+	note := fmt.Sprintf(TruncationNotePrefix+" ~%d tokens reduced to fit a budget of %d tokens, the failed steps and the end of the log were kept ===\n\n", EstimateTokens(logs), maxTokens)
+
+	budget := maxTokens*CharsPerToken - len(note)
+	if budget <= 0 {
+		return note
+	}
+
+	steps := ParseSteps(logs)
+	if len(steps) == 0 {
+		return note + TailOfText(logs, budget)
+	}
+
+	kept := make([]string, len(steps))
+	remaining := budget
+
+	for i, step := range steps {
+		if remaining > 0 && isFailedStep(step.Title, failedSteps) {
+			kept[i] = TailOfText(step.Logs, remaining)
+			remaining -= len(kept[i])
+		}
+	}
+	for i := len(steps) - 1; i >= 0 && remaining > 0; i-- {
+		if isFailedStep(steps[i].Title, failedSteps) {
+			continue
+		}
+		kept[i] = TailOfText(steps[i].Logs, remaining)
+		remaining -= len(kept[i])
+	}
+
+	var result []string
+	for _, stepLogs := range kept {
+		if stepLogs != "" {
+			result = append(result, stepLogs)
+		}
+	}
+	return note + JoinStepLogs(result)
+}
+
+func isFailedStep(stepTitle string, failedSteps []string) bool {
+	for _, failed := range failedSteps {
+		if MatchesStepTitle(stepTitle, failed) {
+			return true
+		}
+	}
+	return false
+}
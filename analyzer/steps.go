@@ -0,0 +1,298 @@
+package analyzer
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// LineBuffer holds back the partial last line of a chunk until the rest of the line arrives.
+type LineBuffer struct {
+	Partial string
+}
+
+// Push returns the complete lines of the buffered text followed by the chunk, keeping the partial last line.
+func (b *LineBuffer) Push(chunk string) string {
+	text := b.Partial + chunk
+	end := strings.LastIndex(text, "\n") + 1
+	b.Partial = text[end:]
+	return text[:end]
+}
+
+// Flush returns the buffered partial line and empties the buffer.
+func (b *LineBuffer) Flush() string {
+	rest := b.Partial
+	b.Partial = ""
+	return rest
+}
+
+// UnknownStepTitle is the title of the single step wrapping logs without step markers
+const UnknownStepTitle = "Unknown"
+
+// StepLogs is the log of a single step of the build
+type StepLogs struct {
+	Title string
+	Logs  string
+	// ExitCode and Duration come from the summary line closing the step,
+	// e.g. "| x | Xcode Test for iOS (exit code: 65) | 45 sec |"
+	ExitCode int
+	Duration string
+}
+
+var (
+	// buildSummaryHeaderPattern matches the header of the table printed at the end of a build
+	buildSummaryHeaderPattern = regexp.MustCompile(`(?i)^\|\s*bitrise summary\s*\|$`)
+	stepExitCodePattern       = regexp.MustCompile(`exit code:\s*(\d+)`)
+	stepDurationPattern       = regexp.MustCompile(`\|\s*(\d+(?:\.\d+)?\s*(?:ms|sec|s|min|m|hours?|h)(?:\s+\d+(?:\.\d+)?\s*(?:sec|s|min|m))?)\s*\|\s*$`)
+)
+
+// IsBuildSummaryHeaderLine reports whether the line opens the summary table printed at the end of a build.
+// Its rows look like step footers but describe every step of the build.
+func IsBuildSummaryHeaderLine(line string) bool {
+	return buildSummaryHeaderPattern.MatchString(strings.TrimSpace(StripANSI(line)))
+}
+
+// ParseStepFooter records the exit code and duration found in a step summary line.
+// The rows of the build summary table must not be passed, see IsBuildSummaryHeaderLine.
+func ParseStepFooter(line string, step *StepLogs) {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "|") {
+		return
+	}
+
+	if match := stepExitCodePattern.FindStringSubmatch(trimmed); match != nil {
+		step.ExitCode, _ = strconv.Atoi(match[1])
+	}
+	if match := stepDurationPattern.FindStringSubmatch(trimmed); match != nil {
+		step.Duration = strings.TrimSpace(match[1])
+	}
+}
+
+// stepResultLine formats the exit code and duration of a step in the summary line format,
+// so it survives filtering and parses back into the same values.
+func stepResultLine(step StepLogs) string {
+	duration := step.Duration
+	if duration == "" {
+		duration = "unknown"
+	}
+	return fmt.Sprintf("| exit code: %d | %s |", step.ExitCode, duration)
+}
+
+// WithStepResult appends the step's exit code and duration to its filtered logs,
+// unless the summary line was kept by the filtering.
+func WithStepResult(filteredLogs string, step StepLogs) string {
+	if step.ExitCode == 0 && step.Duration == "" {
+		return filteredLogs
+	}
+
+	var kept StepLogs
+	for _, line := range strings.Split(filteredLogs, "\n") {
+		if IsBuildSummaryHeaderLine(line) {
+			break
+		}
+		ParseStepFooter(line, &kept)
+	}
+	if kept.ExitCode == step.ExitCode && kept.Duration == step.Duration {
+		return filteredLogs
+	}
+	return strings.TrimRight(filteredLogs, "\n") + "\n" + stepResultLine(step)
+}
+
+// ParseSteps splits the build log at the step boundary markers.
+// Each step keeps its exact text, so joining their logs with JoinStepLogs gives back the original logs.
+func ParseSteps(logs string) []StepLogs {
+	var steps []StepLogs
+	parser := NewStepParser(func(step StepLogs) {
+		steps = append(steps, step)
+	})
+	parser.WriteString(logs)
+	parser.Close()
+
+	return steps
+}
+
+// StepParser splits a build log into steps as it arrives, line by line, handing each step to onStep
+// as soon as the next one starts. Only the current step is held in memory.
+type StepParser struct {
+	onStep func(StepLogs)
+
+	currentStep  *StepLogs
+	currentLogs  strings.Builder
+	unattributed strings.Builder
+	// A box border right above a title line opens the new step, so it's held back until the next line
+	pendingBorder string
+	pendingLines  LineBuffer
+	// inBuildSummary is set once the summary table of the build started, it stays with the last step
+	// without changing its exit code and duration
+	inBuildSummary bool
+}
+
+// NewStepParser returns a parser handing each parsed step to onStep.
+func NewStepParser(onStep func(StepLogs)) *StepParser {
+	return &StepParser{onStep: onStep}
+}
+
+// WriteString parses the complete lines of chunk, the partial last line is held back until the rest arrives.
+func (p *StepParser) WriteString(chunk string) {
+	// SplitAfter keeps the line endings, so the logs are rebuilt exactly
+	for _, rawLine := range strings.SplitAfter(p.pendingLines.Push(chunk), "\n") {
+		if rawLine != "" {
+			p.parseLine(rawLine)
+		}
+	}
+}
+
+func (p *StepParser) parseLine(rawLine string) {
+	line := strings.TrimSuffix(rawLine, "\n")
+
+	// Look for step boundary markers like "| (0) Git Clone Repository |"
+	if IsStepTitleLine(line) {
+		p.finishStep()
+		p.currentStep = &StepLogs{Title: extractStepTitle(line)}
+		p.inBuildSummary = false
+		p.currentLogs.WriteString(p.pendingBorder + rawLine)
+		p.pendingBorder = ""
+		return
+	}
+
+	p.appendLine(p.pendingBorder)
+	p.pendingBorder = ""
+	if IsBoxBorderLine(line) {
+		p.pendingBorder = rawLine
+		return
+	}
+
+	// Regular log line or a boundary that is not the title, add to current step
+	p.appendLine(rawLine)
+	if IsBuildSummaryHeaderLine(line) {
+		p.inBuildSummary = true
+	}
+	if p.currentStep != nil && !p.inBuildSummary {
+		ParseStepFooter(line, p.currentStep)
+	}
+}
+
+func (p *StepParser) appendLine(rawLine string) {
+	if p.currentStep != nil {
+		p.currentLogs.WriteString(rawLine)
+	} else {
+		p.unattributed.WriteString(rawLine)
+	}
+}
+
+// finishStep hands over the current step. Logs before the first step marker, or logs without any step
+// markers (e.g. a custom log format), are handed over first as an Unknown step, so they aren't lost.
+func (p *StepParser) finishStep() {
+	if p.unattributed.Len() > 0 {
+		if strings.TrimSpace(p.unattributed.String()) != "" {
+			p.onStep(StepLogs{Title: UnknownStepTitle, Logs: p.unattributed.String()})
+		}
+		p.unattributed.Reset()
+	}
+
+	if p.currentStep != nil {
+		p.currentStep.Logs = p.currentLogs.String()
+		p.onStep(*p.currentStep)
+		p.currentStep = nil
+		p.currentLogs.Reset()
+	}
+}
+
+// Close parses the last line, even without a newline, and hands over the last step.
+func (p *StepParser) Close() {
+	if rest := p.pendingLines.Flush(); rest != "" {
+		p.parseLine(rest)
+	}
+	p.appendLine(p.pendingBorder)
+	p.pendingBorder = ""
+	p.finishStep()
+}
+
+// JoinStepLogs concatenates the logs of consecutive steps. Step logs already end with a newline,
+// one is only added where it is missing (e.g. after filtering), so no blank lines are introduced.
+func JoinStepLogs(stepLogs []string) string {
+	var result strings.Builder
+	for i, logs := range stepLogs {
+		result.WriteString(logs)
+		if i < len(stepLogs)-1 && logs != "" && !strings.HasSuffix(logs, "\n") {
+			result.WriteString("\n")
+		}
+	}
+	return result.String()
+}
+
+// stepTitleLinePattern matches a step title line like "| (0) Git Clone Repository   |", also after a "+----"
+// boundary on the same line. The step number may be preceded by whitespace or color codes whose escape character
+// was lost, e.g. "[32;1m(12) ". The title is everything between the number and the closing "|" of the box,
+// so a title containing "|" is kept whole.
+var stepTitleLinePattern = regexp.MustCompile(`^[^|]*\|(?:\s|\[[0-9;]*m)*\(\d+\)\s+(.*)\|[^|]*$`)
+
+// IsStepTitleLine reports whether the line opens a step, like "| (0) Git Clone Repository |",
+// either on its own or after a "+----" boundary on the same line.
+func IsStepTitleLine(line string) bool {
+	return stepTitleLinePattern.MatchString(StripANSI(line))
+}
+
+// IsBoxBorderLine reports whether the line is a box border like "+-------+"
+func IsBoxBorderLine(line string) bool {
+	trimmed := strings.TrimSpace(StripANSI(line))
+	return strings.HasPrefix(trimmed, "+-") && strings.Trim(trimmed, "+-") == ""
+}
+
+// extractStepTitle returns the title of a step title line, without the step number and the padding of the box
+func extractStepTitle(line string) string {
+	if match := stepTitleLinePattern.FindStringSubmatch(StripANSI(line)); match != nil {
+		return strings.TrimSpace(match[1])
+	}
+	return ""
+}
+
+// MatchesStepTitle reports whether a step title of the log matches a reported title, e.g. the failed step
+// of $BITRISE_FAILED_STEP_TITLE, also when case, emoji, whitespace or the truncation of the log box make them differ.
+// The whole title must match: "Build" doesn't match the step "Build, test".
+func MatchesStepTitle(stepTitle, failedTitle string) bool {
+	if strings.EqualFold(strings.TrimSpace(stepTitle), strings.TrimSpace(failedTitle)) {
+		return true
+	}
+
+	// Titles in the log can carry emoji, extra whitespace, or be truncated by Bitrise with "..."
+	normalizedStep := normalizeStepTitle(stepTitle)
+	normalizedFailed := normalizeStepTitle(failedTitle)
+	if normalizedStep == "" || normalizedFailed == "" {
+		return false
+	}
+	if normalizedStep == normalizedFailed {
+		return true
+	}
+	if truncated, ok := truncatedTitlePrefix(stepTitle); ok {
+		prefix := normalizeStepTitle(truncated)
+		return prefix != "" && strings.HasPrefix(normalizedFailed, prefix)
+	}
+	return false
+}
+
+// normalizeStepTitle lowercases a title, drops emoji and other symbols and collapses whitespace, for fuzzy matching.
+func normalizeStepTitle(title string) string {
+	var cleaned strings.Builder
+	for _, r := range strings.ToLower(title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsPunct(r) {
+			cleaned.WriteRune(r)
+		} else {
+			cleaned.WriteRune(' ')
+		}
+	}
+	return strings.Join(strings.Fields(cleaned.String()), " ")
+}
+
+// truncatedTitlePrefix returns the title without the ellipsis Bitrise adds to titles too long for the log box.
+func truncatedTitlePrefix(title string) (string, bool) {
+	trimmed := strings.TrimSpace(title)
+	for _, ellipsis := range []string{"...", "…"} {
+		if strings.HasSuffix(trimmed, ellipsis) {
+			return strings.TrimSuffix(trimmed, ellipsis), true
+		}
+	}
+	return "", false
+}
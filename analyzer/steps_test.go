@@ -0,0 +1,159 @@
+package analyzer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSteps(t *testing.T) {
+	tests := []struct {
+		name       string
+		logs       string
+		wantTitles []string
+	}{
+		{
+			name:       "log without step markers",
+			logs:       "$ ./build.sh\nerror: build failed\n",
+			wantTitles: []string{UnknownStepTitle},
+		},
+		{
+			name:       "empty log",
+			logs:       "",
+			wantTitles: nil,
+		},
+		{
+			name: "logs before the first step",
+			logs: "Preparing the build\n" +
+				"+------------------------------------------------------------------------------+\n" +
+				"| (0) Script                                                                   |\n" +
+				"+------------------------------------------------------------------------------+\n" +
+				"echo hello\n",
+			wantTitles: []string{UnknownStepTitle, "Script"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps := ParseSteps(tt.logs)
+
+			var titles []string
+			for _, step := range steps {
+				titles = append(titles, step.Title)
+			}
+			if !reflect.DeepEqual(titles, tt.wantTitles) {
+				t.Errorf("titles = %q, want %q", titles, tt.wantTitles)
+			}
+			if len(tt.wantTitles) == 1 && steps[0].Logs != tt.logs {
+				t.Errorf("logs of the single step = %q, want the whole log %q", steps[0].Logs, tt.logs)
+			}
+		})
+	}
+}
+
+func TestParseStepsRoundTrip(t *testing.T) {
+	golden, err := os.ReadFile(filepath.Join("testdata", "build.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		logs string
+	}{
+		{name: "golden log", logs: string(golden)},
+		{name: "trailing newline", logs: string(golden) + "\n"},
+		{name: "windows line endings", logs: strings.ReplaceAll(string(golden), "\n", "\r\n")},
+	}
+
+	wantSteps := []StepLogs{
+		{Title: UnknownStepTitle},
+		{Title: "Git Clone Repository", Duration: "3.2 sec"},
+		{Title: "Xcode Test for iOS", ExitCode: 65, Duration: "45 sec"},
+		// The build summary table closing the log doesn't belong to the last step's result
+		{Title: "Deploy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps := ParseSteps(tt.logs)
+
+			var stepLogs []string
+			for i := range steps {
+				stepLogs = append(stepLogs, steps[i].Logs)
+				steps[i].Logs = ""
+			}
+			if joined := JoinStepLogs(stepLogs); joined != tt.logs {
+				t.Errorf("joined steps differ from the log:\n%q\nwant\n%q", joined, tt.logs)
+			}
+			if !reflect.DeepEqual(steps, wantSteps) {
+				t.Errorf("steps = %+v, want %+v", steps, wantSteps)
+			}
+		})
+	}
+}
+
+func TestStepTitleLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		wantTitle string
+	}{
+		{
+			name:      "single-digit step number",
+			line:      "| (0) Git Clone Repository                                                     |",
+			wantTitle: "Git Clone Repository",
+		},
+		{
+			name:      "two-digit step number",
+			line:      "| (12) Xcode Archive & Export for iOS                                          |",
+			wantTitle: "Xcode Archive & Export for iOS",
+		},
+		{
+			name:      "three-digit step number",
+			line:      "| (123) Deploy to Bitrise.io                                                   |",
+			wantTitle: "Deploy to Bitrise.io",
+		},
+		{
+			name:      "two-digit step number after color codes",
+			line:      "|\x1b[32;1m (12) Run Unit Tests\x1b[0m                                                  |",
+			wantTitle: "Run Unit Tests",
+		},
+		{
+			name:      "color codes whose escape character was lost",
+			line:      "| [32;1m(105) Run Unit Tests                                                   |",
+			wantTitle: "Run Unit Tests",
+		},
+		{
+			name:      "title after a boundary on the same line",
+			line:      "+-------+| (42) Script                                                         |",
+			wantTitle: "Script",
+		},
+		{
+			name:      "title containing a pipe",
+			line:      "| (3) Build | Test                                                             |",
+			wantTitle: "Build | Test",
+		},
+		{
+			name: "step footer",
+			line: "| x | Xcode Test for iOS (exit code: 65)                             | 45 sec  |",
+		},
+		{
+			name: "box border",
+			line: "+------------------------------------------------------------------------------+",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if isTitle := IsStepTitleLine(tt.line); isTitle != (tt.wantTitle != "") {
+				t.Errorf("IsStepTitleLine = %t, want %t", isTitle, tt.wantTitle != "")
+			}
+			if title := extractStepTitle(tt.line); title != tt.wantTitle {
+				t.Errorf("title = %q, want %q", title, tt.wantTitle)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// BitriseArtifact is an artifact of the build artifacts API, only the fields used to find and download a log
+type BitriseArtifact struct {
+	Title               string `json:"title"`
+	Slug                string `json:"slug"`
+	FileSizeBytes       int64  `json:"file_size_bytes"`
+	ExpiringDownloadURL string `json:"expiring_download_url"`
+}
+
+// BitriseArtifactListResponse is a page of the build artifacts list
+type BitriseArtifactListResponse struct {
+	Data   []BitriseArtifact `json:"data"`
+	Paging struct {
+		Next string `json:"next"`
+	} `json:"paging"`
+}
+
+// BitriseArtifactResponse is the response of the artifact endpoint, which has the download URL
+type BitriseArtifactResponse struct {
+	Data BitriseArtifact `json:"data"`
+}
+
+// fetchBuildArtifacts lists the artifacts of the build, following the pages of the list.
+func fetchBuildArtifacts(ctx context.Context, client httpDoer, token, appSlug, buildSlug string) ([]BitriseArtifact, error) {
+	var artifacts []BitriseArtifact
+	next := ""
+	for {
+		path := fmt.Sprintf("/apps/%s/builds/%s/artifacts", appSlug, buildSlug)
+		if next != "" {
+			path += "?next=" + url.QueryEscape(next)
+		}
+
+		var page BitriseArtifactListResponse
+		if err := getArtifactsAPI(ctx, client, token, path, &page); err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, page.Data...)
+
+		if page.Paging.Next == "" || page.Paging.Next == next {
+			return artifacts, nil
+		}
+		next = page.Paging.Next
+	}
+}
+
+// fetchArtifactDownloadURL returns the presigned download URL of the artifact, which the list doesn't have.
+func fetchArtifactDownloadURL(ctx context.Context, client httpDoer, token, appSlug, buildSlug, artifactSlug string) (string, error) {
+	var artifact BitriseArtifactResponse
+	if err := getArtifactsAPI(ctx, client, token, fmt.Sprintf("/apps/%s/builds/%s/artifacts/%s", appSlug, buildSlug, artifactSlug), &artifact); err != nil {
+		return "", err
+	}
+	if artifact.Data.ExpiringDownloadURL == "" {
+		return "", fmt.Errorf("artifact %s has no download URL", artifactSlug)
+	}
+	return artifact.Data.ExpiringDownloadURL, nil
+}
+
+// getArtifactsAPI decodes the response of a GET request to the artifacts API into v.
+func getArtifactsAPI(ctx context.Context, client httpDoer, token, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL(path), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Authorization", "token "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API request failed with status: %s, body: %s", resp.Status, truncateForError(body))
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to decode artifacts response: %v, body: %s", err, truncateForError(body))
+	}
+	return nil
+}
+
+// findArtifact returns the artifact titled name, compared case-insensitively
+func findArtifact(artifacts []BitriseArtifact, name string) (BitriseArtifact, bool) {
+	for _, artifact := range artifacts {
+		if strings.EqualFold(artifact.Title, name) {
+			return artifact, true
+		}
+	}
+	return BitriseArtifact{}, false
+}
+
+// fetchArtifactLog downloads the artifact named name of the build and returns its contents as the log.
+// Artifacts ending in .gz are decompressed.
+func fetchArtifactLog(ctx context.Context, client httpDoer, token, appSlug, buildSlug, name string) (string, error) {
+	artifacts, err := fetchBuildArtifacts(ctx, client, token, appSlug, buildSlug)
+	if err != nil {
+		return "", fmt.Errorf("failed to list the build artifacts: %v", err)
+	}
+
+	artifact, ok := findArtifact(artifacts, name)
+	if !ok {
+		titles := make([]string, 0, len(artifacts))
+		for _, a := range artifacts {
+			titles = append(titles, a.Title)
+		}
+		return "", fmt.Errorf("no artifact named %q, the build has %d: %s", name, len(artifacts), strings.Join(titles, ", "))
+	}
+	logInfof("Found artifact %s (%d bytes)\n", artifact.Title, artifact.FileSizeBytes)
+
+	downloadURL, err := fetchArtifactDownloadURL(ctx, client, token, appSlug, buildSlug, artifact.Slug)
+	if err != nil {
+		return "", err
+	}
+
+	// The URL is presigned like the one of the raw log, so the same download applies
+	var content strings.Builder
+	if err := downloadRawLog(ctx, client, downloadURL, &content); err != nil {
+		return "", err
+	}
+	if !isGzipPath(artifact.Title) {
+		return content.String(), nil
+	}
+
+	reader, err := gzip.NewReader(strings.NewReader(content.String()))
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress artifact %s: %v", artifact.Title, err)
+	}
+	defer reader.Close()
+	logs, err := io.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress artifact %s: %v", artifact.Title, err)
+	}
+	return string(logs), nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
+)
+
+// BuildStep is the metadata of a step of the build, as listed by the build details endpoint
+type BuildStep struct {
+	Title  string `json:"title"`
+	StepID string `json:"step_id"`
+	Status string `json:"status"`
+}
+
+// BitriseBuildDetails is the part of the build details used by the analyzer
+type BitriseBuildDetails struct {
+	TriggeredWorkflow string      `json:"triggered_workflow"`
+	Steps             []BuildStep `json:"steps"`
+	// Status is one of the buildStatus values
+	Status int `json:"status"`
+}
+
+// Build statuses of the builds API
+const (
+	buildStatusRunning            = 0
+	buildStatusSuccess            = 1
+	buildStatusFailed             = 2
+	buildStatusAborted            = 3 // aborted with failure
+	buildStatusAbortedWithSuccess = 4
+)
+
+// Build states returned by fetchBuildStatus
+const (
+	buildStateRunning = "running"
+	buildStateSuccess = "success"
+	buildStateFailed  = "failed"
+	buildStateAborted = "aborted"
+)
+
+// fetchBuildStatus returns the state of the build from the build details: running, success, failed or aborted.
+func fetchBuildStatus(ctx context.Context, client httpDoer, token, appSlug, buildSlug string) (string, error) {
+	details, err := fetchBuildDetails(ctx, client, token, appSlug, buildSlug)
+	if err != nil {
+		return "", err
+	}
+
+	switch details.Status {
+	case buildStatusRunning:
+		return buildStateRunning, nil
+	case buildStatusSuccess:
+		return buildStateSuccess, nil
+	case buildStatusFailed:
+		return buildStateFailed, nil
+	case buildStatusAborted, buildStatusAbortedWithSuccess:
+		return buildStateAborted, nil
+	default:
+		return "", fmt.Errorf("unknown build status %d", details.Status)
+	}
+}
+
+// BitriseBuildDetailsResponse is the response of the build details endpoint
+type BitriseBuildDetailsResponse struct {
+	Data BitriseBuildDetails `json:"data"`
+}
+
+// buildSteps is the step metadata of the analyzed build, empty when it couldn't be fetched
+var buildSteps []BuildStep
+
+// fetchBuildDetails returns the workflow of the build and its steps in run order.
+func fetchBuildDetails(ctx context.Context, client httpDoer, token, appSlug, buildSlug string) (BitriseBuildDetails, error) {
+	url := apiURL(fmt.Sprintf("/apps/%s/builds/%s", appSlug, buildSlug))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return BitriseBuildDetails{}, err
+	}
+
+	req.Header.Add("Authorization", "token "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return BitriseBuildDetails{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return BitriseBuildDetails{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return BitriseBuildDetails{}, fmt.Errorf("API request failed with status: %s, body: %s", resp.Status, truncateForError(body))
+	}
+
+	var details BitriseBuildDetailsResponse
+	if err := json.Unmarshal(body, &details); err != nil {
+		return BitriseBuildDetails{}, fmt.Errorf("failed to decode build details: %v, body: %s", err, truncateForError(body))
+	}
+	return details.Data, nil
+}
+
+// buildStepForTitle finds the metadata of a parsed step, by exact title first, then allowing
+// the truncated titles of the log markers.
+func buildStepForTitle(title string) (BuildStep, bool) {
+	for _, step := range buildSteps {
+		if strings.EqualFold(step.Title, title) {
+			return step, true
+		}
+	}
+	for _, step := range buildSteps {
+		if analyzer.MatchesStepTitle(title, step.Title) || analyzer.MatchesStepTitle(step.Title, title) {
+			return step, true
+		}
+	}
+	return BuildStep{}, false
+}
+
+// stepTypeOf detects the type of a step from its title, or else from the step ID of its metadata,
+// e.g. a step titled "Run the tests" whose ID is xcode-test is an xcode step.
+func stepTypeOf(title, patterns string) string {
+	if stepType := analyzer.DetectStepType(title, patterns, keywordMatchMode()); stepType != "" {
+		return stepType
+	}
+	if step, ok := buildStepForTitle(title); ok && step.StepID != "" {
+		return analyzer.DetectStepType(step.StepID, patterns, keywordMatchMode())
+	}
+	return ""
+}
+
+// failedStepFromBuildSteps returns the title of the first failed step of the metadata, or "" when none failed.
+func failedStepFromBuildSteps() string {
+	for _, step := range buildSteps {
+		switch strings.ToLower(step.Status) {
+		case "failed", "error", "failure":
+			return step.Title
+		}
+	}
+	return ""
+}
+
+// warnUnmatchedBuildSteps reports parsed steps missing from the metadata, which are typed by their title only.
+func warnUnmatchedBuildSteps(steps []analyzer.StepLogs) {
+	if len(buildSteps) == 0 {
+		return
+	}
+	for _, step := range steps {
+		if step.Title == analyzer.UnknownStepTitle {
+			continue
+		}
+		if _, ok := buildStepForTitle(step.Title); !ok {
+			logVerbosef("Step '%s' is not in the build step metadata\n", step.Title)
+		}
+	}
+}
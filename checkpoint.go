@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// logCheckpoint records how far the log collection got, so a retried step resumes instead of
+// fetching the whole log again. The logs collected so far are kept next to it, in <checkpoint_file>.log.
+type logCheckpoint struct {
+	BuildSlug      string `json:"build_slug"`
+	Position       int    `json:"position"`
+	AfterTimestamp string `json:"after_timestamp,omitempty"`
+	// PendingLine is the partial last line not collected yet, it is completed by the next chunk
+	PendingLine string `json:"pending_line,omitempty"`
+	// LogBytes is the length of the checkpoint logs at Position. Logs appended by a poll whose checkpoint
+	// wasn't saved, e.g. when the step was killed in between, are dropped on load and fetched again.
+	LogBytes int `json:"log_bytes"`
+}
+
+func checkpointLogPath(checkpointFile string) string {
+	return checkpointFile + ".log"
+}
+
+// loadCheckpoint returns the checkpoint and the logs collected before it, when both exist and the
+// checkpoint belongs to the build. A checkpoint of another build is removed.
+func loadCheckpoint(checkpointFile, buildSlug string) (logCheckpoint, string, bool) {
+	content, err := os.ReadFile(checkpointFile)
+	if err != nil {
+		return logCheckpoint{}, "", false
+	}
+
+	var checkpoint logCheckpoint
+	if err := json.Unmarshal(content, &checkpoint); err != nil {
+		logWarnf("⚠️  Warning: ignoring invalid checkpoint %s: %v\n", checkpointFile, err)
+		clearCheckpoint(checkpointFile)
+		return logCheckpoint{}, "", false
+	}
+	if checkpoint.BuildSlug != buildSlug {
+		logInfof("Checkpoint %s belongs to build %s, starting over\n", checkpointFile, checkpoint.BuildSlug)
+		clearCheckpoint(checkpointFile)
+		return logCheckpoint{}, "", false
+	}
+
+	logs, err := os.ReadFile(checkpointLogPath(checkpointFile))
+	if err != nil {
+		logWarnf("⚠️  Warning: checkpoint logs are missing, starting over: %v\n", err)
+		clearCheckpoint(checkpointFile)
+		return logCheckpoint{}, "", false
+	}
+	if len(logs) < checkpoint.LogBytes {
+		logWarnf("⚠️  Warning: checkpoint logs are shorter than the checkpoint, starting over\n")
+		clearCheckpoint(checkpointFile)
+		return logCheckpoint{}, "", false
+	}
+	if len(logs) > checkpoint.LogBytes {
+		logVerbosef("Dropping %d bytes of checkpoint logs collected after the checkpoint\n", len(logs)-checkpoint.LogBytes)
+		if err := os.Truncate(checkpointLogPath(checkpointFile), int64(checkpoint.LogBytes)); err != nil {
+			logWarnf("⚠️  Warning: could not truncate the checkpoint logs, starting over: %v\n", err)
+			clearCheckpoint(checkpointFile)
+			return logCheckpoint{}, "", false
+		}
+		logs = logs[:checkpoint.LogBytes]
+	}
+	return checkpoint, string(logs), true
+}
+
+func saveCheckpoint(checkpointFile string, checkpoint logCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	if err := writeLogFile(checkpointFile, string(data)+"\n"); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %v", err)
+	}
+	return nil
+}
+
+// appendCheckpointLogs adds newly collected logs next to the checkpoint.
+func appendCheckpointLogs(checkpointFile, logs string) error {
+	sink := newOutputSink(checkpointLogPath(checkpointFile))
+	if err := sink.Write(logs); err != nil {
+		sink.Close()
+		return err
+	}
+	return sink.Close()
+}
+
+// clearCheckpoint removes the checkpoint and its logs, once the collection finished or they are stale.
+func clearCheckpoint(checkpointFile string) {
+	for _, path := range []string{checkpointFile, checkpointLogPath(checkpointFile)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logWarnf("⚠️  Warning: could not remove %s: %v\n", path, err)
+		}
+	}
+}
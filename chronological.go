@@ -0,0 +1,109 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
+)
+
+// log_order values: the logs grouped by step as printed by Bitrise, or every line in time order annotated with its step
+const (
+	logOrderSteps         = "steps"
+	logOrderChronological = "chronological"
+)
+
+// chronologicalOrderEnabled reports whether log_order asks for the lines of all steps in time order
+func chronologicalOrderEnabled() bool {
+	return strings.EqualFold(strings.TrimSpace(getInput("log_order")), logOrderChronological)
+}
+
+// lineTimestampPattern matches the timestamp prefix of a line, e.g. "2024-05-01T10:00:01.123Z ", "[10:00:01] ",
+// with the optional date, the time and the optional fraction of a second as groups
+var lineTimestampPattern = regexp.MustCompile(`^\[?(?:(\d{4}-\d{2}-\d{2})[T ])?(\d{2}:\d{2}:\d{2})(?:[.,](\d{1,9}))?(?:Z|[+-]\d{2}:?\d{2})?\]?\s`)
+
+// lineTimestamp returns a sortable form of the timestamp prefix of the line, false when it has none.
+// Timestamps are compared as text, fractions are padded so "10:00:01.5" sorts after "10:00:01.25".
+func lineTimestamp(line string) (string, bool) {
+	match := lineTimestampPattern.FindStringSubmatch(strings.TrimLeft(line, " \t"))
+	if match == nil {
+		return "", false
+	}
+	fraction := match[3] + strings.Repeat("0", 9-len(match[3]))
+	return match[1] + "T" + match[2] + "." + fraction, true
+}
+
+// stepLinePrefix annotates a line with its step in chronological order, e.g. "[Xcode Test for iOS] "
+func stepLinePrefix(title string) string {
+	return "[" + title + "] "
+}
+
+// annotateStepLines prefixes each line of the step with its title, dropping the title box and
+// blank lines which only make sense when the lines are grouped by step.
+func annotateStepLines(stepLogs, title string) string {
+	lines := strings.Split(stepLogs, "\n")
+	annotated := make([]string, 0, len(lines))
+	prefix := stepLinePrefix(title)
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" || analyzer.IsBoxBorderLine(line) || analyzer.IsStepTitleLine(line) {
+			continue
+		}
+		annotated = append(annotated, prefix+line)
+	}
+	return strings.Join(annotated, "\n")
+}
+
+// orderLinesChronologically sorts the lines annotated by annotateStepLines by their timestamp prefix, so the
+// output of parallel steps is interleaved as it happened. Lines without a timestamp keep their place after the
+// previous timestamped line of their step, or of any step before the first one of their step.
+// Logs without any timestamps are returned unchanged, in step order.
+func orderLinesChronologically(logs string) string {
+	type timedLine struct {
+		text      string
+		timestamp string
+	}
+
+	lines := strings.Split(logs, "\n")
+	timed := make([]timedLine, 0, len(lines))
+	lastTimestamps := map[string]string{}
+	lastTimestamp := ""
+	for _, line := range lines {
+		step, rest := splitStepLinePrefix(line)
+		timestamp, ok := lineTimestamp(rest)
+		if ok {
+			lastTimestamps[step] = timestamp
+			lastTimestamp = timestamp
+		} else if previous, seen := lastTimestamps[step]; seen {
+			timestamp = previous
+		} else {
+			timestamp = lastTimestamp
+		}
+		timed = append(timed, timedLine{text: line, timestamp: timestamp})
+	}
+	if lastTimestamp == "" {
+		return logs
+	}
+
+	sort.SliceStable(timed, func(i, j int) bool {
+		return timed[i].timestamp < timed[j].timestamp
+	})
+
+	ordered := make([]string, len(timed))
+	for i, line := range timed {
+		ordered[i] = line.text
+	}
+	return strings.Join(ordered, "\n")
+}
+
+// splitStepLinePrefix splits an annotated line into its step title and the original line
+func splitStepLinePrefix(line string) (string, string) {
+	if !strings.HasPrefix(line, "[") {
+		return "", line
+	}
+	end := strings.Index(line, "] ")
+	if end < 0 {
+		return "", line
+	}
+	return line[1:end], line[end+2:]
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
+)
+
+// filterCommandName is the subcommand applying the step filtering to a local log file,
+// e.g. `analyzer filter --log build.log --patterns patterns.txt`
+const filterCommandName = "filter"
+
+// runFilterCommand prints the filtered logs to stdout to tune step_log_filter_patterns without
+// running a build or accessing the network. It returns the exit code of the process.
+func runFilterCommand(args []string) int {
+	flags := flag.NewFlagSet(filterCommandName, flag.ContinueOnError)
+	logFile := flags.String("log", "", "build log file to filter (required)")
+	patternsFile := flags.String("patterns", "", "file with the step_log_filter_patterns, the built-in patterns when empty")
+	configFile := flags.String("config", "", "JSON or YAML file with other inputs, e.g. match_mode or context_lines_after")
+	verbose := flags.Bool("verbose", false, "print the detected step types along with the filtered logs")
+	if err := flags.Parse(args); err != nil {
+		return exitConfigError
+	}
+	if *logFile == "" {
+		logErrorf("Usage: %s %s --log <file> [--patterns <file>] [--config <file>] [--verbose]\n", os.Args[0], filterCommandName)
+		return exitConfigError
+	}
+
+	if *configFile != "" {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			logErrorf("Error loading config: %v\n", err)
+			return exitConfigError
+		}
+		stepConfig = config
+	}
+
+	logs, err := os.ReadFile(*logFile)
+	if err != nil {
+		logErrorf("Error reading log file: %v\n", err)
+		return exitConfigError
+	}
+
+	// The filtering is always enabled, without a patterns file it uses the built-in patterns
+	patterns := ""
+	if *patternsFile != "" {
+		content, err := os.ReadFile(*patternsFile)
+		if err != nil {
+			logErrorf("Error reading patterns file: %v\n", err)
+			return exitConfigError
+		}
+		patterns = string(content)
+	}
+
+	// Progress messages would be mixed into the filtered logs on stdout
+	currentLogLevel = logLevelQuiet
+	if *verbose {
+		currentLogLevel = logLevelVerbose
+	}
+
+	loadRedactionPatterns()
+	filter := newStepFilterWithPatterns(enabledFilterPatterns(patterns))
+	fmt.Print(optimizeSteps(cleanLogs(string(logs), true), filter, analyzer.Options{}))
+	return exitSuccess
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLogPage is one response of fakeBitriseAPI: the log response as JSON, or the status and body when set
+type fakeLogPage struct {
+	status     int
+	retryAfter string
+	body       string
+	response   BitriseLogResponse
+}
+
+// fakeBitriseAPI serves the log endpoint of a build from httptest.Server: each request gets the next page,
+// the last page is served again once all were served, like a finished build polled once more.
+type fakeBitriseAPI struct {
+	mu       sync.Mutex
+	pages    []fakeLogPage
+	requests []string
+}
+
+// newFakeBitriseAPI starts the server and points bitrise_api_base_url to it for the test
+func newFakeBitriseAPI(t *testing.T, pages ...fakeLogPage) *fakeBitriseAPI {
+	t.Helper()
+	api := &fakeBitriseAPI{pages: pages}
+	server := httptest.NewServer(http.HandlerFunc(api.serveLog))
+	t.Cleanup(server.Close)
+	t.Setenv("bitrise_api_base_url", server.URL)
+	return api
+}
+
+func (api *fakeBitriseAPI) serveLog(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	index := len(api.requests)
+	api.requests = append(api.requests, r.URL.RequestURI())
+	api.mu.Unlock()
+
+	if !strings.HasSuffix(r.URL.Path, "/log") || r.Header.Get("Authorization") != "token test-token" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+
+	page := api.pages[len(api.pages)-1]
+	if index < len(api.pages) {
+		page = api.pages[index]
+	}
+	if page.retryAfter != "" {
+		w.Header().Set("Retry-After", page.retryAfter)
+	}
+	if page.status != 0 {
+		w.WriteHeader(page.status)
+	}
+	if page.body != "" || page.status != 0 {
+		w.Write([]byte(page.body))
+		return
+	}
+	json.NewEncoder(w).Encode(page.response)
+}
+
+// Requests returns the URIs of the log requests served so far
+func (api *fakeBitriseAPI) Requests() []string {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return append([]string(nil), api.requests...)
+}
+
+// logPage is a log response with the given chunks, numbered from firstPosition
+func logPage(archived bool, firstPosition int, chunks ...string) fakeLogPage {
+	page := fakeLogPage{response: BitriseLogResponse{IsArchived: archived, LogChunks: []LogChunk{}}}
+	for i, chunk := range chunks {
+		page.response.LogChunks = append(page.response.LogChunks, LogChunk{Chunk: chunk, Position: firstPosition + i})
+	}
+	return page
+}
+
+// testCollectorOptions polls the fake API every second for at most a minute of clk time
+func testCollectorOptions(clk clock) collectorOptions {
+	return collectorOptions{
+		token:     "test-token",
+		appSlug:   "test-app",
+		buildSlug: "test-build",
+		interval:  time.Second,
+		maxWait:   time.Minute,
+		stats:     &collectionStats{},
+		client:    http.DefaultClient,
+		clock:     clk,
+	}
+}
+
+func TestFetchLogChunk(t *testing.T) {
+	chunks := logPage(false, 0, "line 1\n", "line 2\n")
+
+	tests := []struct {
+		name       string
+		pages      []fakeLogPage
+		wantChunks int
+		wantErr    string
+		wantSleeps []time.Duration
+	}{
+		{
+			name:       "returns the chunks of a 200",
+			pages:      []fakeLogPage{chunks},
+			wantChunks: 2,
+		},
+		{
+			name:    "does not retry a 401",
+			pages:   []fakeLogPage{{status: http.StatusUnauthorized, body: "unauthorized"}, chunks},
+			wantErr: "401",
+		},
+		{
+			name:       "retries a 429 after its Retry-After",
+			pages:      []fakeLogPage{{status: http.StatusTooManyRequests, retryAfter: "7"}, chunks},
+			wantChunks: 2,
+			wantSleeps: []time.Duration{7 * time.Second},
+		},
+		{
+			name:       "fails on invalid JSON once the retries are used up",
+			pages:      []fakeLogPage{{body: "<html>bad gateway</html>"}},
+			wantErr:    "invalid JSON",
+			wantSleeps: []time.Duration{time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("max_retries", "1")
+			newFakeBitriseAPI(t, tt.pages...)
+			clk := newFakeClock(time.Unix(0, 0))
+
+			response, err := fetchLogChunk(context.Background(), http.DefaultClient, "test-token", "test-app", "test-build", logCursor{}, clk, time.Time{})
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to mention %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(response.LogChunks) != tt.wantChunks {
+				t.Errorf("got %d chunks, want %d", len(response.LogChunks), tt.wantChunks)
+			}
+			if got := clk.Sleeps(); !equalDurations(got, tt.wantSleeps) {
+				t.Errorf("slept %v, want %v", got, tt.wantSleeps)
+			}
+		})
+	}
+}
+
+func TestCollectBuildLogsUnauthorizedIsAPIError(t *testing.T) {
+	api := newFakeBitriseAPI(t, fakeLogPage{status: http.StatusUnauthorized, body: "unauthorized"})
+
+	_, err := collectBuildLogs(context.Background(), testCollectorOptions(newFakeClock(time.Unix(0, 0))))
+
+	if code := exitCodeOf(err); code != exitAPIError {
+		t.Errorf("exit code = %d (%v), want exitAPIError", code, err)
+	}
+	if requests := api.Requests(); len(requests) != 1 {
+		t.Errorf("got %d requests, want 1: %v", len(requests), requests)
+	}
+}
+
+func equalDurations(a, b []time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// clock is where the collection loop reads the time and waits between polls, so the max wait
+// and the poll backoff can be exercised with fakeClock without really waiting
+type clock interface {
+	Now() time.Time
+	// Sleep waits for d, returning false if the context is cancelled first
+	Sleep(ctx context.Context, d time.Duration) bool
+}
+
+// realClock is the wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) bool {
+	return sleepWithContext(ctx, d)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when slept on or advanced, and records the sleeps, e.g. to check the poll intervals
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func newFakeClock(start time.Time) *fakeClock {
+	return &fakeClock{now: start}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep advances the time by d right away, unless the context is already cancelled
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.sleeps = append(c.sleeps, d)
+	return true
+}
+
+// Advance moves the time forward without recording a sleep, e.g. for a slow API response
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Sleeps returns the durations slept so far
+func (c *fakeClock) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.sleeps...)
+}
+
+func TestCollectBuildLogsStopsAtMaxWait(t *testing.T) {
+	logCompleteness = ""
+	api := newFakeBitriseAPI(t, logPage(false, 0, "Compiling\n"), logPage(false, 1))
+	start := time.Unix(0, 0)
+	clk := newFakeClock(start)
+	opts := testCollectorOptions(clk)
+	opts.maxWait = 10 * time.Second
+
+	logs, err := collectBuildLogs(context.Background(), opts)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if logCompleteness != logCompletenessTimedOut || collectionExitCode() != exitTimeout {
+		t.Errorf("log completeness = %q, want %q", logCompleteness, logCompletenessTimedOut)
+	}
+	if logs != "Compiling\n" {
+		t.Errorf("logs = %q, want the logs collected before the max wait", logs)
+	}
+	if elapsed := clk.Now().Sub(start); elapsed != opts.maxWait {
+		t.Errorf("collection took %s, want %s", elapsed, opts.maxWait)
+	}
+	// One poll per interval, without sleeping past the max wait
+	if sleeps, polls := len(clk.Sleeps()), len(api.Requests()); sleeps != 10 || polls != 11 {
+		t.Errorf("slept %d times over %d polls, want 10 over 11", sleeps, polls)
+	}
+}
+
+func TestFetchLogChunkBackoff(t *testing.T) {
+	unavailable := fakeLogPage{status: http.StatusServiceUnavailable}
+	rateLimited := fakeLogPage{status: http.StatusTooManyRequests, retryAfter: "120"}
+
+	tests := []struct {
+		name       string
+		page       fakeLogPage
+		deadline   time.Duration
+		wantSleeps []time.Duration
+		wantErr    error
+	}{
+		{
+			name:       "doubles the wait between retries",
+			page:       unavailable,
+			wantSleeps: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			name:       "waits the Retry-After of the server",
+			page:       rateLimited,
+			wantSleeps: []time.Duration{120 * time.Second, 120 * time.Second, 120 * time.Second},
+		},
+		{
+			name:       "cuts the Retry-After to the deadline",
+			page:       rateLimited,
+			deadline:   30 * time.Second,
+			wantSleeps: []time.Duration{30 * time.Second},
+			wantErr:    errRetryDeadline,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("max_retries", "3")
+			newFakeBitriseAPI(t, tt.page)
+			start := time.Unix(0, 0)
+			clk := newFakeClock(start)
+			var deadline time.Time
+			if tt.deadline > 0 {
+				deadline = start.Add(tt.deadline)
+			}
+
+			_, err := fetchLogChunk(context.Background(), http.DefaultClient, "test-token", "test-app", "test-build", logCursor{}, clk, deadline)
+
+			if err == nil {
+				t.Fatal("expected the fetch to fail")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if got := clk.Sleeps(); !equalDurations(got, tt.wantSleeps) {
+				t.Errorf("slept %v, want %v", got, tt.wantSleeps)
+			}
+		})
+	}
+}
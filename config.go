@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Config holds the inputs read from the file given in the config input, keyed by input name,
+// e.g. {"interval": 5, "output_file": "build.log"}. Environment variables override the file values.
+type Config struct {
+	Path   string
+	Values map[string]string
+}
+
+// stepConfig is loaded at startup, inputs missing from the environment are looked up in it
+var stepConfig = Config{Values: map[string]string{}}
+
+// getInput returns an input from the environment, or from the config file when not set there.
+// Defaults are applied by the callers, so the precedence is defaults < config file < environment.
+func getInput(key string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return stepConfig.Values[key]
+}
+
+// loadFilterPatternsFile loads step_log_filter_patterns_file as the step_log_filter_patterns when those are empty,
+// so teams can keep a shared, reviewed patterns file in their repository instead of a blob in the workflow.
+// The patterns are stored with the config file inputs, the environment of the step is left as it is.
+func loadFilterPatternsFile() error {
+	path := strings.TrimSpace(getInput("step_log_filter_patterns_file"))
+	if path == "" {
+		return nil
+	}
+	if strings.TrimSpace(getInput("step_log_filter_patterns")) != "" {
+		logInfof("step_log_filter_patterns is set, ignoring step_log_filter_patterns_file\n")
+		return nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read step_log_filter_patterns_file: %v", err)
+	}
+	logInfof("Loaded step_log_filter_patterns from %s\n", path)
+	if stepConfig.Values == nil {
+		stepConfig.Values = map[string]string{}
+	}
+	stepConfig.Values["step_log_filter_patterns"] = string(content)
+	return nil
+}
+
+// loadConfig reads a JSON (.json) or YAML config file.
+func loadConfig(path string) (Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var values map[string]string
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		values, err = parseJSONConfig(content)
+	} else {
+		values, err = parseYAMLConfig(string(content))
+	}
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	return Config{Path: path, Values: values}, nil
+}
+
+// parseJSONConfig reads a flat JSON object, numbers and booleans are kept as their literal text.
+func parseJSONConfig(content []byte) (map[string]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for key, rawValue := range raw {
+		var text string
+		if err := json.Unmarshal(rawValue, &text); err == nil {
+			values[key] = text
+			continue
+		}
+
+		literal := strings.TrimSpace(string(rawValue))
+		if strings.HasPrefix(literal, "{") || strings.HasPrefix(literal, "[") {
+			return nil, fmt.Errorf("value of %s must be a string, number or boolean", key)
+		}
+		if literal != "null" {
+			values[key] = literal
+		}
+	}
+	return values, nil
+}
+
+// parseYAMLConfig reads the flat subset of YAML used by config files: `key: value` lines,
+// quoted values, and `|` / `|-` block scalars for multi-line values like the filter patterns.
+func parseYAMLConfig(content string) (map[string]string, error) {
+	values := map[string]string{}
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			return nil, fmt.Errorf("line %d: unexpected indentation, only top-level keys are supported", i+1)
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("line %d: expected `key: value`", i+1)
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		if value == "|" || value == "|-" {
+			block, next := readYAMLBlock(lines, i+1)
+			if value == "|" && block != "" {
+				block += "\n"
+			}
+			values[key] = block
+			i = next - 1
+			continue
+		}
+
+		parsed, err := unquoteYAMLValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		values[key] = parsed
+	}
+	return values, nil
+}
+
+// readYAMLBlock collects the indented lines of a block scalar starting at start,
+// returning them dedented and the index of the first line after the block.
+func readYAMLBlock(lines []string, start int) (string, int) {
+	indent := -1
+	var block []string
+	i := start
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if strings.TrimSpace(line) == "" {
+			block = append(block, "")
+			continue
+		}
+		lineIndent := len(line) - len(strings.TrimLeft(line, " \t"))
+		if lineIndent == 0 {
+			break
+		}
+		if indent == -1 {
+			indent = lineIndent
+		}
+		block = append(block, line[minInt(indent, lineIndent):])
+	}
+
+	// Blank lines between the block and the next key don't belong to the block
+	for len(block) > 0 && block[len(block)-1] == "" {
+		block = block[:len(block)-1]
+	}
+	return strings.Join(block, "\n"), i
+}
+
+func unquoteYAMLValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid double-quoted value %s", value)
+		}
+		return unquoted, nil
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("invalid single-quoted value %s", value)
+		}
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	}
+
+	// Unquoted values can end with a comment
+	if idx := strings.Index(value, " #"); idx != -1 {
+		value = strings.TrimSpace(value[:idx])
+	}
+	return value, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// defaultExtraContextMaxBytes caps each extra context file, lock files can be huge
+const defaultExtraContextMaxBytes = 20000
+
+// contextFile is a project file given to the analysis along with the logs, e.g. package.json
+type contextFile struct {
+	Path    string
+	Content string
+	// Truncated is true when only the first extra_context_max_bytes of the file are in Content
+	Truncated bool
+}
+
+// loadExtraContextFiles reads the comma-separated extra_context_files, each capped to extra_context_max_bytes.
+// Missing or unreadable files are logged and skipped. Secrets are masked like in the logs.
+func loadExtraContextFiles() []contextFile {
+	maxBytes := getEnvInt("extra_context_max_bytes", defaultExtraContextMaxBytes)
+	if maxBytes <= 0 {
+		maxBytes = defaultExtraContextMaxBytes
+	}
+
+	var files []contextFile
+	for _, path := range strings.Split(getInput("extra_context_files"), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		file, err := readContextFile(path, maxBytes)
+		if err != nil {
+			logWarnf("⚠️  Warning: skipping extra context file %s: %v\n", path, err)
+			continue
+		}
+		logInfof("Adding %s to the analysis context (%d bytes)\n", path, len(file.Content))
+		files = append(files, file)
+	}
+	return files
+}
+
+// readContextFile reads up to maxBytes of the file, cut at the last complete line when truncated
+func readContextFile(path string, maxBytes int) (contextFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return contextFile{}, err
+	}
+	defer f.Close()
+
+	// One byte more than the cap tells whether the file was truncated
+	content, err := io.ReadAll(io.LimitReader(f, int64(maxBytes)+1))
+	if err != nil {
+		return contextFile{}, fmt.Errorf("failed to read: %v", err)
+	}
+
+	truncated := len(content) > maxBytes
+	if truncated {
+		content = content[:maxBytes]
+		if end := strings.LastIndex(string(content), "\n"); end > 0 {
+			content = content[:end+1]
+		}
+	}
+	return contextFile{Path: path, Content: strings.TrimRight(redactSecrets(strings.ToValidUTF8(string(content), "")), "\n"), Truncated: truncated}, nil
+}
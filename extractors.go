@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
+)
+
+// maxExtractedErrorLines caps the extracted block, the full step logs follow it anyway
+const maxExtractedErrorLines = 40
+
+const (
+	extractedErrorsHeader = "=== Extracted %s errors ==="
+	extractedErrorsFooter = "=== End of extracted errors ==="
+)
+
+// errorExtractor pulls the canonical error block of a build tool out of the logs of a step,
+// where generic keyword matching would only find scattered lines.
+type errorExtractor struct {
+	name string
+	// stepTypes are the step types of the filter patterns (and keywords of step titles) selecting the extractor
+	stepTypes []string
+	extract   func(lines []string) []string
+}
+
+var (
+	gradleFailedTaskPattern = regexp.MustCompile(`^> Task \S+ FAILED\s*$`)
+	xcodeFailedPattern      = regexp.MustCompile(`^\*\* (?:BUILD|TEST|ARCHIVE) FAILED \*\*`)
+	xcodeErrorPattern       = regexp.MustCompile(`(?:^|\s)(?:fatal )?error: `)
+	goPackagePattern        = regexp.MustCompile(`^# \S+$`)
+	goFileErrorPattern      = regexp.MustCompile(`\.go:\d+(?::\d+)?: `)
+	goTestFailPattern       = regexp.MustCompile(`^(?:\s*--- FAIL: |FAIL\s)`)
+)
+
+// errorExtractors are tried in order when the step title doesn't select one
+var errorExtractors = []errorExtractor{
+	{name: "gradle", stepTypes: []string{"gradle", "android"}, extract: extractGradleErrors},
+	{name: "xcode", stepTypes: []string{"xcode", "ios"}, extract: extractXcodeErrors},
+	{name: "npm", stepTypes: []string{"npm", "yarn", "node"}, extract: extractNpmErrors},
+	{name: "go", stepTypes: []string{"go", "golang"}, extract: extractGoErrors},
+}
+
+// extractGradleErrors keeps the failed tasks and the "FAILURE: Build failed" block up to its "* Try:" hints.
+func extractGradleErrors(lines []string) []string {
+	var extracted []string
+	inFailure := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "FAILURE: Build failed"):
+			inFailure = true
+		case inFailure && (strings.HasPrefix(trimmed, "* Try:") || strings.HasPrefix(trimmed, "BUILD FAILED")):
+			inFailure = false
+			extracted = append(extracted, line)
+			continue
+		}
+		if inFailure || gradleFailedTaskPattern.MatchString(trimmed) {
+			extracted = append(extracted, line)
+		}
+	}
+	return extracted
+}
+
+// extractXcodeErrors keeps the compiler errors, with the source line and caret following them,
+// and the "The following build commands failed:" list closed by "** BUILD FAILED **".
+func extractXcodeErrors(lines []string) []string {
+	var extracted []string
+	inFailedCommands := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "The following build commands failed:"):
+			inFailedCommands = true
+		case xcodeFailedPattern.MatchString(trimmed):
+			inFailedCommands = false
+			extracted = append(extracted, line)
+			continue
+		case xcodeErrorPattern.MatchString(line):
+			extracted = append(extracted, line)
+			// clang and swiftc print the offending source line and a caret under the error
+			for j := i + 1; j < len(lines) && j <= i+2; j++ {
+				if strings.Contains(lines[j], "^") {
+					extracted = append(extracted, lines[i+1:j+1]...)
+					break
+				}
+			}
+			continue
+		}
+		if inFailedCommands {
+			if trimmed == "" {
+				inFailedCommands = false
+				continue
+			}
+			extracted = append(extracted, line)
+		}
+	}
+	return extracted
+}
+
+// extractNpmErrors keeps the "npm ERR!" (npm 10: "npm error") lines and yarn's "error" lines.
+func extractNpmErrors(lines []string) []string {
+	var extracted []string
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "npm ERR!") || strings.HasPrefix(trimmed, "npm error") ||
+			strings.HasPrefix(trimmed, "error ") || strings.HasPrefix(trimmed, "ERR_") {
+			extracted = append(extracted, line)
+		}
+	}
+	return extracted
+}
+
+// extractGoErrors keeps the "# package" headers with the compiler errors under them, and the failed tests.
+func extractGoErrors(lines []string) []string {
+	var extracted []string
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case goPackagePattern.MatchString(trimmed):
+			// Only headers of packages that failed to build, not "# comments" of scripts
+			if i+1 < len(lines) && goFileErrorPattern.MatchString(lines[i+1]) {
+				extracted = append(extracted, line)
+			}
+		case goFileErrorPattern.MatchString(line), goTestFailPattern.MatchString(line):
+			extracted = append(extracted, line)
+		}
+	}
+	return extracted
+}
+
+// errorExtractorForStep selects the extractor of a step by its type in the filter patterns,
+// or by the step title and ID themselves, e.g. "Android Build" selects the gradle extractor.
+func errorExtractorForStep(stepTitle, patterns string) *errorExtractor {
+	if stepTitle == "" {
+		return nil
+	}
+
+	if patterns != "" {
+		if stepType := stepTypeOf(stepTitle, patterns); stepType != "" {
+			if extractor := errorExtractorByStepType(stepType); extractor != nil {
+				return extractor
+			}
+		}
+	}
+
+	// The step ID, e.g. gradle-runner, names the tool even when the title doesn't
+	titleLower := strings.ToLower(stepTitle)
+	if step, ok := buildStepForTitle(stepTitle); ok {
+		titleLower += " " + strings.ToLower(step.StepID)
+	}
+	for i := range errorExtractors {
+		for _, stepType := range errorExtractors[i].stepTypes {
+			if analyzer.NewKeywordMatcher(stepType, analyzer.MatchModeWord)(titleLower) {
+				return &errorExtractors[i]
+			}
+		}
+	}
+	return nil
+}
+
+func errorExtractorByStepType(stepType string) *errorExtractor {
+	for i := range errorExtractors {
+		for _, t := range errorExtractors[i].stepTypes {
+			if strings.EqualFold(t, stepType) {
+				return &errorExtractors[i]
+			}
+		}
+	}
+	return nil
+}
+
+// extractStepErrors returns the canonical error block of a step, or "" when none is found.
+// Steps whose title selects no extractor (e.g. script steps running gradle) try all of them in order.
+func extractStepErrors(step analyzer.StepLogs, patterns string) string {
+	lines := strings.Split(step.Logs, "\n")
+
+	candidates := errorExtractors
+	if extractor := errorExtractorForStep(step.Title, patterns); extractor != nil {
+		candidates = []errorExtractor{*extractor}
+	}
+
+	for _, extractor := range candidates {
+		extracted := extractor.extract(lines)
+		if len(extracted) == 0 {
+			continue
+		}
+		logVerbosef("Extracted %d %s error lines from step '%s'\n", len(extracted), extractor.name, step.Title)
+		if len(extracted) > maxExtractedErrorLines {
+			extracted = extracted[:maxExtractedErrorLines]
+		}
+
+		block := []string{fmt.Sprintf(extractedErrorsHeader, extractor.name)}
+		block = append(block, extracted...)
+		block = append(block, extractedErrorsFooter)
+		return strings.Join(block, "\n")
+	}
+	return ""
+}
+
+// prependExtractedErrors inserts the extracted error block right after the step title box,
+// so it is the first thing read about the step.
+func prependExtractedErrors(stepLogs, extracted string) string {
+	if extracted == "" {
+		return stepLogs
+	}
+
+	lines := strings.Split(stepLogs, "\n")
+	headerEnd := 0
+	for i, line := range lines {
+		if analyzer.IsStepTitleLine(line) {
+			headerEnd = i + 1
+			if headerEnd < len(lines) && analyzer.IsBoxBorderLine(lines[headerEnd]) {
+				headerEnd++
+			}
+			break
+		}
+	}
+
+	result := append([]string{}, lines[:headerEnd]...)
+	result = append(result, extracted)
+	result = append(result, lines[headerEnd:]...)
+	return strings.Join(result, "\n")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
+)
+
+// Issue categories of the issues summary
+const (
+	issueCategoryBuild   = "build"
+	issueCategoryTest    = "test"
+	issueCategoryNetwork = "network"
+	issueCategorySigning = "signing"
+	issueCategoryUnknown = "unknown"
+)
+
+// maxIssueSnippetLength keeps the snippets of the issues summary short enough for dashboards
+const maxIssueSnippetLength = 300
+
+// issueCategoryKeywords maps the categories to the keywords identifying them, checked in order
+// since a line can match several (e.g. "error: No signing certificate" is a signing issue, not a build one)
+var issueCategoryKeywords = []struct {
+	category string
+	keywords []string
+}{
+	{issueCategorySigning, []string{"codesign", "code signing", "signing certificate", "provisioning profile", "keychain"}},
+	{issueCategoryNetwork, []string{"timed out", "timeout", "connection refused", "connection reset", "could not resolve host", "unknownhostexception", "ssl", "network"}},
+	{issueCategoryTest, []string{"test case", "test suite", "tests failed", "test failed", "xctassert", "assert"}},
+	{issueCategoryBuild, []string{"error:", "build failed", "compilation failed", "fatal error", "failure:", "cannot find symbol"}},
+}
+
+// Issue is a failure found in the logs of a step, for aggregating failure categories across builds
+type Issue struct {
+	StepTitle string `json:"step_title"`
+	Category  string `json:"category"`
+	Snippet   string `json:"snippet"`
+}
+
+type IssuesSummary struct {
+	Issues []Issue `json:"issues"`
+}
+
+// classifyIssueLine returns the category of a log line, or "" when the line doesn't look like a failure.
+func classifyIssueLine(line string) string {
+	lineLower := strings.ToLower(line)
+	for _, entry := range issueCategoryKeywords {
+		for _, keyword := range entry.keywords {
+			if strings.Contains(lineLower, keyword) {
+				return entry.category
+			}
+		}
+	}
+
+	if failureIndicatorPattern.MatchString(line) {
+		return issueCategoryUnknown
+	}
+	return ""
+}
+
+// buildIssuesSummary classifies the lines kept by the filtering, with one issue per step and category,
+// using the first matching line as the representative snippet.
+func buildIssuesSummary(optimizedLogs string) IssuesSummary {
+	summary := IssuesSummary{Issues: []Issue{}}
+
+	for _, step := range analyzer.ParseSteps(optimizedLogs) {
+		seen := map[string]bool{}
+		for _, line := range strings.Split(step.Logs, "\n") {
+			// Box lines only carry the step title and result
+			if analyzer.IsBoxBorderLine(line) || analyzer.IsStepTitleLine(line) {
+				continue
+			}
+
+			category := classifyIssueLine(line)
+			if category == "" || seen[category] {
+				continue
+			}
+			seen[category] = true
+
+			snippet := strings.TrimSpace(line)
+			if len(snippet) > maxIssueSnippetLength {
+				snippet = strings.ToValidUTF8(snippet[:maxIssueSnippetLength], "") + "..."
+			}
+			summary.Issues = append(summary.Issues, Issue{StepTitle: step.Title, Category: category, Snippet: snippet})
+		}
+	}
+
+	return summary
+}
+
+// writeIssuesSummary writes the issues summary of the optimized logs as JSON.
+func writeIssuesSummary(filePath, optimizedLogs string) error {
+	summary := buildIssuesSummary(optimizedLogs)
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeLogFile(filePath, string(data)+"\n"); err != nil {
+		return fmt.Errorf("failed to write issues summary: %v", err)
+	}
+	logInfof("Saved %d issues to %s\n", len(summary.Issues), filePath)
+	return nil
+}
+
+// Failure classes exported in AI_ANALYZER_FAILURE_CLASS
+const (
+	failureClassInfrastructure = "infrastructure"
+	failureClassUser           = "user"
+	failureClassUnknown        = "unknown"
+	// failureClassAborted is a build aborted by a user or the API, it is not analyzed
+	failureClassAborted = "aborted"
+)
+
+// abortedBuildPattern matches the lines Bitrise and the step runner log when a build is aborted
+var abortedBuildPattern = regexp.MustCompile(`(?i)build (?:was |has been )?aborted|aborted by (?:the )?user|abort(?:ed)? with (?:failure|success)|received abort signal`)
+
+// abortedLogTailLines is how many lines at the end of the log are searched for abortedBuildPattern,
+// an earlier "aborted" line is e.g. the output of a test and not the end of the build
+const abortedLogTailLines = 20
+
+// infrastructureFailurePattern matches lost runners, network and resource problems, which aren't caused by the code
+var infrastructureFailurePattern = regexp.MustCompile(`(?i)runner (?:was |has been )?lost|lost (?:connection|communication) (?:to|with) the (?:machine|runner|vm)|received a shutdown signal|no space left on device|out of memory|connection (?:timed out|refused|reset)|could not resolve host|unknownhostexception|temporary failure in name resolution|network is unreachable|read timed out|etimedout|econnreset|socket hang up|tls handshake timeout|502 bad gateway|503 service unavailable|504 gateway time-?out|too many requests`)
+
+// failureClass is the class of the build failure, set by classifyFailure
+var failureClass = failureClassUnknown
+
+// classifyFailure tells infrastructure failures apart from failures of the user's code or configuration,
+// by counting infrastructure and other failure lines in the failed steps, or the whole log when none is known.
+// The failure is infrastructure when those lines are at least as common as the others.
+func classifyFailure(logs string) string {
+	failedLogs := logs
+	if steps := findFailedSteps(analyzer.ParseSteps(logs), failedStepsFromEnv()); len(steps) > 0 {
+		failedLogs = reconstructLogsFromSteps(steps)
+	}
+
+	infraLines, otherLines := 0, 0
+	for _, line := range strings.Split(failedLogs, "\n") {
+		switch {
+		case infrastructureFailurePattern.MatchString(line):
+			infraLines++
+		case failureIndicatorPattern.MatchString(line):
+			otherLines++
+		}
+	}
+
+	switch {
+	case infraLines > 0 && infraLines >= otherLines:
+		return failureClassInfrastructure
+	case otherLines > 0:
+		return failureClassUser
+	default:
+		return failureClassUnknown
+	}
+}
+
+// isBuildAborted tells whether the build was aborted instead of failing, from its status when it was
+// fetched during the collection, otherwise from the last lines of the logs
+func isBuildAborted(buildStatus, logs string) bool {
+	if buildStatus != "" {
+		return buildStatus == buildStateAborted
+	}
+	return abortedBuildPattern.MatchString(analyzer.TailStepLines(logs, abortedLogTailLines))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
+)
+
+// lastSuccessBuild and lastSuccessLogs are the last successful build of the workflow and its log,
+// set when diff_against_last_success is enabled and the build was found
+var (
+	lastSuccessBuild BitriseBuild
+	lastSuccessLogs  string
+)
+
+// fetchLastSuccessfulBuild returns the most recent successful build of the app's workflow.
+func fetchLastSuccessfulBuild(ctx context.Context, client httpDoer, token, appSlug, workflow string) (BitriseBuild, error) {
+	url := apiURL(fmt.Sprintf("/apps/%s/builds?workflow=%s&status=%d&limit=1", appSlug, url.QueryEscape(workflow), buildStatusSuccess))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return BitriseBuild{}, err
+	}
+
+	req.Header.Add("Authorization", "token "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return BitriseBuild{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return BitriseBuild{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return BitriseBuild{}, fmt.Errorf("API request failed with status: %s, body: %s", resp.Status, truncateForError(body))
+	}
+
+	var builds BitriseBuildListResponse
+	if err := json.Unmarshal(body, &builds); err != nil {
+		return BitriseBuild{}, fmt.Errorf("failed to decode builds list: %v, body: %s", err, truncateForError(body))
+	}
+	if len(builds.Data) == 0 {
+		return BitriseBuild{}, fmt.Errorf("no successful build of workflow %s found", workflow)
+	}
+	return builds.Data[0], nil
+}
+
+// loadLastSuccessLogs fetches the log of the last successful build of the workflow into lastSuccessLogs,
+// cleaned the same way as the collected logs. Failures are logged, the logs are then analyzed whole.
+func loadLastSuccessLogs(ctx context.Context, client httpDoer, token, appSlug, workflow string, strip bool) {
+	if workflow == "" {
+		logWarnf("⚠️  Warning: the workflow of the build is not known, not comparing with the last successful build\n")
+		return
+	}
+
+	build, err := fetchLastSuccessfulBuild(ctx, client, token, appSlug, workflow)
+	if err != nil {
+		logWarnf("⚠️  Warning: could not find the last successful build: %v\n", err)
+		return
+	}
+
+	logs, _, err := fetchCompleteLog(ctx, client, token, appSlug, build.Slug)
+	if err != nil {
+		logWarnf("⚠️  Warning: could not fetch the log of the last successful build #%d: %v\n", build.BuildNumber, err)
+		return
+	}
+	if strings.TrimSpace(logs) == "" {
+		logWarnf("⚠️  Warning: the log of the last successful build #%d is empty\n", build.BuildNumber)
+		return
+	}
+
+	logInfof("🟢 Comparing the failed steps with the last successful build #%d (%s)\n", build.BuildNumber, build.Slug)
+	lastSuccessBuild = build
+	lastSuccessLogs = analyzer.CollapseCarriageReturns(cleanLogs(logs, strip))
+}
+
+// volatileNumberPattern matches the numbers making the same line differ from build to build,
+// e.g. timestamps, durations and counters
+var volatileNumberPattern = regexp.MustCompile(`[0-9]+`)
+
+// diffLine is the form of a line compared between builds
+func diffLine(line string) string {
+	return volatileNumberPattern.ReplaceAllString(strings.TrimSpace(line), "0")
+}
+
+// diffFailedStepsAgainst keeps only the lines of the failed steps which are not in the same step of the
+// previous logs, so the analysis focuses on what changed. Other steps, and failed steps the previous logs
+// don't have, are left whole.
+func diffFailedStepsAgainst(logs, previousLogs string) string {
+	previousLines := map[string]map[string]bool{}
+	for _, step := range analyzer.ParseSteps(previousLogs) {
+		lines := map[string]bool{}
+		for _, line := range strings.Split(step.Logs, "\n") {
+			lines[diffLine(line)] = true
+		}
+		previousLines[strings.ToLower(step.Title)] = lines
+	}
+
+	failedSteps := failedStepsFromEnv()
+	steps := analyzer.ParseSteps(logs)
+	diffed := make([]string, 0, len(steps))
+	for _, step := range steps {
+		if !isReportedFailedStep(step.Title, failedSteps) {
+			diffed = append(diffed, step.Logs)
+			continue
+		}
+
+		previous, ok := previousLines[strings.ToLower(step.Title)]
+		if !ok {
+			logVerbosef("Step '%s' is not in the last successful build, keeping it whole\n", step.Title)
+			diffed = append(diffed, step.Logs)
+			continue
+		}
+		diffed = append(diffed, diffStepLogs(step.Logs, previous))
+	}
+	return analyzer.JoinStepLogs(diffed)
+}
+
+// diffStepLogs keeps the title box of the step and its lines missing from previous,
+// each run of dropped lines is replaced with a note of how many there were.
+func diffStepLogs(stepLogs string, previous map[string]bool) string {
+	lines := strings.Split(stepLogs, "\n")
+	kept := make([]string, 0, len(lines))
+	dropped := 0
+	inHeader := true
+	for _, line := range lines {
+		if inHeader {
+			kept = append(kept, line)
+			inHeader = !analyzer.IsStepTitleLine(line)
+			continue
+		}
+
+		// Blank lines within a run of dropped lines are dropped along with it
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" && dropped > 0 {
+			continue
+		}
+		// Box lines, e.g. the step ID and the summary of the step, are always kept
+		if trimmed != "" && previous[diffLine(line)] && !strings.HasPrefix(trimmed, "|") && !analyzer.IsBoxBorderLine(line) {
+			dropped++
+			continue
+		}
+		if dropped > 0 {
+			kept = append(kept, droppedLinesNote(dropped))
+			dropped = 0
+		}
+		kept = append(kept, line)
+	}
+	if dropped > 0 {
+		kept = append(kept, droppedLinesNote(dropped))
+	}
+	return strings.Join(kept, "\n")
+}
+
+func droppedLinesNote(dropped int) string {
+	if dropped == 1 {
+		return "    (1 line also in the last successful build)"
+	}
+	return fmt.Sprintf("    (%d lines also in the last successful build)", dropped)
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
+)
+
+const (
+	defaultOpenAIBaseURL     = "https://api.openai.com/v1"
+	defaultOpenAIModel       = "gpt-4o-mini"
+	defaultAnthropicBaseURL  = "https://api.anthropic.com"
+	defaultAnthropicModel    = "claude-3-5-sonnet-latest"
+	defaultAzureAPIVersion   = "2024-02-01"
+	defaultLLMTimeoutSeconds = 120
+	anthropicAPIVersion      = "2023-06-01"
+	anthropicMaxTokens       = 4096
+	// defaultAnalysisWindowTokens is the size of the parts of a chunked analysis when max_tokens is not set
+	defaultAnalysisWindowTokens = 30000
+	// maxSummaryRounds limits how many times the part summaries are summarized again to fit one request
+	maxSummaryRounds = 3
+)
+
+const analysisSystemPrompt = "You are an expert CI/CD engineer debugging failed Bitrise builds."
+
+// llmProvider sends a prompt to an LLM and returns its answer. Each supported API has its own implementation,
+// selected with the llm_provider input.
+type llmProvider interface {
+	// Analyze is cancelled with ctx, e.g. when CI tears the step down
+	Analyze(ctx context.Context, prompt string) (string, error)
+}
+
+// newLLMProvider creates the provider configured by llm_provider (openai, anthropic or azure),
+// rate limited and retrying as configured by llm_requests_per_minute and llm_max_retries.
+func newLLMProvider() (llmProvider, error) {
+	provider, err := newLLMProviderAPI()
+	if err != nil {
+		return nil, err
+	}
+	return newRateLimitedProvider(llmProviderName(), provider), nil
+}
+
+// newLLMProviderAPI creates the client of the API of the configured provider.
+func newLLMProviderAPI() (llmProvider, error) {
+	apiKey := llmAPIKey()
+	baseURL := strings.TrimSpace(getInput("llm_base_url"))
+	model := strings.TrimSpace(getInput("llm_model"))
+
+	switch llmProviderName() {
+	case "openai":
+		if baseURL == "" {
+			baseURL = defaultOpenAIBaseURL
+		}
+		if model == "" {
+			model = defaultOpenAIModel
+		}
+		return openAIProvider{baseURL: baseURL, apiKey: apiKey, model: model}, nil
+	case "anthropic":
+		if baseURL == "" {
+			baseURL = defaultAnthropicBaseURL
+		}
+		if model == "" {
+			model = defaultAnthropicModel
+		}
+		return anthropicProvider{baseURL: baseURL, apiKey: apiKey, model: model}, nil
+	case "azure":
+		if baseURL == "" || model == "" {
+			return nil, fmt.Errorf("the azure provider requires llm_base_url (the resource endpoint) and llm_model (the deployment name)")
+		}
+		apiVersion := strings.TrimSpace(getInput("azure_api_version"))
+		if apiVersion == "" {
+			apiVersion = defaultAzureAPIVersion
+		}
+		return azureOpenAIProvider{endpoint: baseURL, apiKey: apiKey, deployment: model, apiVersion: apiVersion}, nil
+	default:
+		return nil, fmt.Errorf("unknown llm_provider: %s (supported: openai, anthropic, azure)", llmProviderName())
+	}
+}
+
+func llmProviderName() string {
+	provider := strings.ToLower(strings.TrimSpace(getInput("llm_provider")))
+	if provider == "" {
+		return "openai"
+	}
+	return provider
+}
+
+// llmAPIKey returns the key for the configured provider. The anthropic provider falls back to claude_api_key.
+func llmAPIKey() string {
+	if apiKey := getInput("llm_api_key"); apiKey != "" {
+		return apiKey
+	}
+	if llmProviderName() == "anthropic" {
+		return getInput("claude_api_key")
+	}
+	return ""
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatCompletionRequest struct {
+	Model    string        `json:"model,omitempty"`
+	Messages []chatMessage `json:"messages"`
+}
+
+type chatCompletionResponse struct {
+	Choices []struct {
+		Message chatMessage `json:"message"`
+	} `json:"choices"`
+}
+
+// openAIProvider talks to an OpenAI-compatible chat completions API
+type openAIProvider struct {
+	baseURL string
+	apiKey  string
+	model   string
+}
+
+func (p openAIProvider) Analyze(ctx context.Context, prompt string) (string, error) {
+	var completion chatCompletionResponse
+	err := postLLMRequest(
+		ctx,
+		strings.TrimRight(p.baseURL, "/")+"/chat/completions",
+		map[string]string{"Authorization": "Bearer " + p.apiKey},
+		newChatCompletionRequest(p.model, prompt),
+		&completion,
+	)
+	if err != nil {
+		return "", err
+	}
+	return firstChoiceContent(completion)
+}
+
+// azureOpenAIProvider talks to an Azure OpenAI deployment, which is addressed by deployment name
+// and authenticates with an api-key header
+type azureOpenAIProvider struct {
+	endpoint   string
+	apiKey     string
+	deployment string
+	apiVersion string
+}
+
+func (p azureOpenAIProvider) Analyze(ctx context.Context, prompt string) (string, error) {
+	requestURL := fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s",
+		strings.TrimRight(p.endpoint, "/"), url.PathEscape(p.deployment), url.QueryEscape(p.apiVersion))
+
+	var completion chatCompletionResponse
+	err := postLLMRequest(
+		ctx,
+		requestURL,
+		map[string]string{"api-key": p.apiKey},
+		newChatCompletionRequest("", prompt),
+		&completion,
+	)
+	if err != nil {
+		return "", err
+	}
+	return firstChoiceContent(completion)
+}
+
+func newChatCompletionRequest(model, prompt string) chatCompletionRequest {
+	return chatCompletionRequest{
+		Model: model,
+		Messages: []chatMessage{
+			{Role: "system", Content: analysisSystemPrompt},
+			{Role: "user", Content: prompt},
+		},
+	}
+}
+
+func firstChoiceContent(completion chatCompletionResponse) (string, error) {
+	if len(completion.Choices) == 0 || strings.TrimSpace(completion.Choices[0].Message.Content) == "" {
+		return "", fmt.Errorf("LLM response contains no analysis")
+	}
+	return completion.Choices[0].Message.Content, nil
+}
+
+type anthropicMessagesRequest struct {
+	Model     string        `json:"model"`
+	MaxTokens int           `json:"max_tokens"`
+	System    string        `json:"system"`
+	Messages  []chatMessage `json:"messages"`
+}
+
+type anthropicMessagesResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+}
+
+// anthropicProvider talks to the Anthropic Messages API
+type anthropicProvider struct {
+	baseURL string
+	apiKey  string
+	model   string
+}
+
+func (p anthropicProvider) Analyze(ctx context.Context, prompt string) (string, error) {
+	var message anthropicMessagesResponse
+	err := postLLMRequest(
+		ctx,
+		strings.TrimRight(p.baseURL, "/")+"/v1/messages",
+		map[string]string{"x-api-key": p.apiKey, "anthropic-version": anthropicAPIVersion},
+		anthropicMessagesRequest{
+			Model:     p.model,
+			MaxTokens: anthropicMaxTokens,
+			System:    analysisSystemPrompt,
+			Messages:  []chatMessage{{Role: "user", Content: prompt}},
+		},
+		&message,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	var text strings.Builder
+	for _, block := range message.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	if strings.TrimSpace(text.String()) == "" {
+		return "", fmt.Errorf("LLM response contains no analysis")
+	}
+	return text.String(), nil
+}
+
+// postLLMRequest posts payload as JSON with the given headers and decodes the JSON response into out.
+func postLLMRequest(ctx context.Context, requestURL string, headers map[string]string, payload, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	// Completions take much longer than Bitrise API calls, but reuse the shared connection pool
+	timeoutSeconds := getEnvInt("llm_timeout_seconds", defaultLLMTimeoutSeconds)
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultLLMTimeoutSeconds
+	}
+	client := &http.Client{Transport: httpClient.Transport, Timeout: time.Duration(timeoutSeconds) * time.Second}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("LLM request failed with status: %s, body: %s", resp.Status, truncateForError(respBody))
+		// Rate limited and overloaded providers are retried, after the wait they ask for
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return retryableError{err: err, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+		}
+		if resp.StatusCode >= 500 {
+			return retryableError{err: err}
+		}
+		return err
+	}
+
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("failed to parse LLM response: %v", err)
+	}
+	return nil
+}
+
+// runAnalysis asks the LLM for a root cause analysis, saves it to outputFile (stdout when empty or -)
+// and exports it for subsequent steps.
+func runAnalysis(ctx context.Context, logs, workflowYAML, outputFile string) error {
+	logInfof("🤖 Analyzing the build logs with the %s LLM provider...\n", llmProviderName())
+	analysis, err := analyzeWithLLM(ctx, logs, workflowYAML)
+	if err != nil {
+		return err
+	}
+	if markdownOutputEnabled() {
+		analysis = formatMarkdownAnalysis(analysis, logs)
+	}
+
+	// Printed after the logs, the analysis gets its own markers on stdout
+	if stdoutOutput && (outputFile == "" || outputFile == stdoutOutputFile) {
+		err = writeStdoutBlock("ANALYSIS", analysis)
+		outputFile = ""
+	} else {
+		err = writeLogFile(outputFile, analysis)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save analysis: %v", err)
+	}
+	if outputFile != "" && outputFile != stdoutOutputFile {
+		logInfof("Saved AI analysis to %s\n", outputFile)
+	}
+
+	if err := exportEnvVar("BITRISE_AI_REVIEW", analysis); err != nil {
+		logWarnf("⚠️  Warning: could not export BITRISE_AI_REVIEW: %v\n", err)
+	}
+	return nil
+}
+
+// analyzeWithLLM sends the optimized logs to the configured LLM provider
+// and returns the suggested root cause and fix.
+func analyzeWithLLM(ctx context.Context, logs, workflowYAML string) (string, error) {
+	provider, err := newLLMProvider()
+	if err != nil {
+		return "", err
+	}
+
+	// Logs too large for a single request are summarized part by part, then analyzed from the summaries
+	summarized := false
+	if chunkedAnalysisEnabled() {
+		windowTokens := analysisWindowTokens()
+		if analyzer.EstimateTokens(logs) > windowTokens {
+			logs, err = summarizeInParts(ctx, provider, logs, windowTokens)
+			if err != nil {
+				return "", err
+			}
+			summarized = true
+		}
+	}
+
+	prompt, err := buildAnalysisPrompt(logs, workflowYAML, summarized)
+	if err != nil {
+		return "", err
+	}
+
+	return provider.Analyze(ctx, prompt)
+}
+
+func chunkedAnalysisEnabled() bool {
+	return getInput("enable_chunked_analysis") == "true"
+}
+
+// analysisWindowTokens is the size of each part of a chunked analysis, the max_tokens budget when set.
+func analysisWindowTokens() int {
+	if maxTokens := getEnvInt("max_tokens", 0); maxTokens > 0 {
+		return maxTokens
+	}
+	return defaultAnalysisWindowTokens
+}
+
+const partSummaryPromptTemplate = `This is part %d of %d of the logs of a failed Bitrise build, too large to be analyzed at once.
+Summarize what matters to find the root cause of the failure: the steps in this part, their errors and failures
+with the exact messages, file names and exit codes. Leave out successful output. Use short plain text.
+%s
+=== BUILD LOGS (PART %d OF %d) ===
+%s
+=== END BUILD LOGS ===`
+
+// summarizeInParts splits the logs into windows of windowTokens at step boundaries and summarizes each one.
+// The summaries are summarized again, up to maxSummaryRounds times, until they fit a single window.
+func summarizeInParts(ctx context.Context, provider llmProvider, logs string, windowTokens int) (string, error) {
+	failedStepNote := ""
+	if failedStep := getInput("BITRISE_FAILED_STEP_TITLE"); failedStep != "" {
+		failedStepNote = fmt.Sprintf("The failed step is: %s\n", failedStep)
+	} else if detected, guessed := detectedFailedStep(); guessed {
+		failedStepNote = fmt.Sprintf("The failed step is probably: %s\n", detected)
+	} else if detected != "" {
+		failedStepNote = fmt.Sprintf("The failed step is: %s\n", detected)
+	}
+
+	for round := 1; round <= maxSummaryRounds && analyzer.EstimateTokens(logs) > windowTokens; round++ {
+		windows := splitIntoAnalysisWindows(logs, windowTokens)
+		logInfof("📚 Logs exceed ~%d tokens, summarizing them in %d parts (round %d)...\n", windowTokens, len(windows), round)
+
+		summaries := make([]string, 0, len(windows))
+		for i, window := range windows {
+			prompt := fmt.Sprintf(partSummaryPromptTemplate, i+1, len(windows), failedStepNote, i+1, len(windows), window)
+			summary, err := provider.Analyze(ctx, prompt)
+			if err != nil {
+				return "", fmt.Errorf("failed to summarize part %d of %d: %v", i+1, len(windows), err)
+			}
+			summaries = append(summaries, fmt.Sprintf("=== Summary of part %d of %d ===\n%s", i+1, len(windows), strings.TrimSpace(summary)))
+		}
+		logs = strings.Join(summaries, "\n\n") + "\n"
+	}
+
+	return logs, nil
+}
+
+// splitIntoAnalysisWindows packs consecutive steps into windows of at most windowTokens,
+// steps larger than a window are split at line boundaries.
+func splitIntoAnalysisWindows(logs string, windowTokens int) []string {
+	maxBytes := windowTokens * analyzer.CharsPerToken
+
+	var windows []string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			windows = append(windows, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, step := range analyzer.ParseSteps(logs) {
+		if len(step.Logs) > maxBytes {
+			flush()
+			windows = append(windows, splitAtLines(step.Logs, maxBytes)...)
+			continue
+		}
+		if current.Len()+len(step.Logs) > maxBytes {
+			flush()
+		}
+		current.WriteString(step.Logs)
+	}
+	flush()
+
+	return windows
+}
+
+// splitAtLines splits text into pieces of at most maxBytes ending at line boundaries,
+// only a single line longer than maxBytes makes a larger piece.
+func splitAtLines(text string, maxBytes int) []string {
+	var pieces []string
+	var current strings.Builder
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if current.Len() > 0 && current.Len()+len(line) > maxBytes {
+			pieces = append(pieces, current.String())
+			current.Reset()
+		}
+		current.WriteString(line)
+	}
+	if current.Len() > 0 {
+		pieces = append(pieces, current.String())
+	}
+	return pieces
+}
+
+// promptData is available to prompt templates, e.g. {{.Logs}} or {{.FailedStep}}
+type promptData struct {
+	Logs       string
+	FailedStep string
+	// FailedStepGuessed is true when FailedStep was guessed from the logs, not reported by Bitrise
+	FailedStepGuessed bool
+	ErrorMessage      string
+	WorkflowYAML      string
+	// FailureClass is "infrastructure", "user" or "unknown"
+	FailureClass string
+	// LogsSummarized is true when Logs holds summaries of the parts of logs too large for a single request
+	LogsSummarized bool
+	// LogCompleteness is "finished_archived", "stopped_at_sentinel", "stopped_at_first_error", "timed_out", "cancelled", "input_file" or "artifact"
+	LogCompleteness string
+	// LastSuccessBuild is the number of the successful build the failed steps were diffed against, 0 when not diffed
+	LastSuccessBuild int
+	// Chronological is true when the lines of all steps are in time order, each prefixed with its step
+	Chronological bool
+	// ContextFiles are the project files of extra_context_files, e.g. package.json or a CHANGELOG
+	ContextFiles []contextFile
+	// MarkdownSections is true when output_format is markdown, the answer is posted as a PR comment
+	MarkdownSections bool
+	// MachineInfo describes the build machine when include_machine_info is enabled, each with .Name and .Value
+	MachineInfo []machineInfoField
+}
+
+const defaultPromptTemplate = `Analyze the logs of this failed Bitrise build. Explain the most likely root cause of the failure, then suggest how to fix it. Use markdown format.
+{{if .FailedStep}}
+Failed step: {{.FailedStep}}{{if .FailedStepGuessed}} (not reported by Bitrise, guessed from the logs){{end}}
+{{end}}{{if .ErrorMessage}}
+Error message: {{.ErrorMessage}}
+{{end}}{{if eq .FailureClass "infrastructure"}}
+The logs point to an infrastructure failure (lost runner, network or resource problem). Focus on that and don't blame the project's code unless the logs clearly show it.
+{{end}}{{if or (eq .LogCompleteness "timed_out") (eq .LogCompleteness "cancelled") (eq .LogCompleteness "stopped_at_sentinel") (eq .LogCompleteness "stopped_at_first_error")}}
+The logs are partial ({{.LogCompleteness}}), the build may have continued after them. Mention it when it limits your conclusions.
+{{end}}{{if .LogsSummarized}}
+The logs were too large for a single request, they are given as summaries of consecutive parts.
+{{end}}{{if .LastSuccessBuild}}
+The failed steps only show the lines which are not in the last successful build (#{{.LastSuccessBuild}}) of the workflow, the regression is likely among them.
+{{end}}{{if .MarkdownSections}}
+Start with a one or two sentence summary, then use exactly these two headings: "### Likely cause" and "### Suggested fix". The answer is posted as a pull request comment.
+{{end}}{{if .MachineInfo}}
+Build machine:{{range .MachineInfo}}
+- {{.Name}}: {{.Value}}{{end}}
+Consider whether the machine (e.g. its CPU architecture or Xcode version) explains the failure.
+{{end}}{{if .Chronological}}
+The lines of all steps are in the order they were printed, each prefixed with its step title in brackets. Steps may have run in parallel, look for a step's failure affecting another.
+{{end}}
+=== BUILD LOGS ===
+{{.Logs}}
+=== END BUILD LOGS ===
+{{if .WorkflowYAML}}
+=== WORKFLOW CONFIGURATION (bitrise.yml) ===
+{{.WorkflowYAML}}
+=== END WORKFLOW CONFIGURATION ===
+{{end}}{{range .ContextFiles}}
+=== PROJECT FILE ({{.Path}}){{if .Truncated}} (truncated){{end}} ===
+{{.Content}}
+=== END PROJECT FILE ===
+{{end}}`
+
+// promptTemplate returns the prompt_template input, the content of prompt_template_file,
+// or the built-in template, in that order of precedence.
+func promptTemplate() (string, error) {
+	if inline := getInput("prompt_template"); strings.TrimSpace(inline) != "" {
+		return inline, nil
+	}
+
+	if templateFile := strings.TrimSpace(getInput("prompt_template_file")); templateFile != "" {
+		content, err := os.ReadFile(templateFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read prompt template file: %v", err)
+		}
+		return string(content), nil
+	}
+
+	return defaultPromptTemplate, nil
+}
+
+func buildAnalysisPrompt(logs, workflowYAML string, summarized bool) (string, error) {
+	templateText, err := promptTemplate()
+	if err != nil {
+		return "", err
+	}
+
+	tmpl, err := template.New("prompt").Parse(templateText)
+	if err != nil {
+		return "", fmt.Errorf("invalid prompt template: %v", err)
+	}
+
+	var prompt strings.Builder
+	data := promptData{
+		Logs:             logs,
+		FailedStep:       getInput("BITRISE_FAILED_STEP_TITLE"),
+		ErrorMessage:     getInput("BITRISE_FAILED_STEP_ERROR_MESSAGE"),
+		WorkflowYAML:     workflowYAML,
+		FailureClass:     failureClass,
+		LogCompleteness:  logCompleteness,
+		LogsSummarized:   summarized,
+		LastSuccessBuild: lastSuccessBuild.BuildNumber,
+		Chronological:    chronologicalOrderEnabled(),
+		ContextFiles:     loadExtraContextFiles(),
+		MarkdownSections: markdownOutputEnabled(),
+		MachineInfo:      machineInfo,
+	}
+	if data.FailedStep == "" {
+		data.FailedStep, data.FailedStepGuessed = detectedFailedStep()
+	}
+	err = tmpl.Execute(&prompt, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to render prompt template: %v", err)
+	}
+
+	return prompt.String(), nil
+}
+
+// truncateForError keeps error messages readable when an API returns a large body
+func truncateForError(body []byte) string {
+	const maxLen = 300
+	text := strings.TrimSpace(string(body))
+	if len(text) > maxLen {
+		return strings.ToValidUTF8(text[:maxLen], "") + "..."
+	}
+	return text
+}
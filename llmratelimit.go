@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultLLMMaxRetries is how many times a rate limited or failed LLM request is repeated
+const defaultLLMMaxRetries = 3
+
+// rateLimiter is a token bucket allowing requestsPerMinute requests, one at a time: each request
+// takes the token refilled 60s/requestsPerMinute after the previous one, so bursts are spread out.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(requestsPerMinute int) *rateLimiter {
+	return &rateLimiter{interval: time.Minute / time.Duration(requestsPerMinute)}
+}
+
+// wait blocks until the next request is allowed, returning false if the context is cancelled first
+func (l *rateLimiter) wait(ctx context.Context) bool {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return true
+	}
+	logVerbosef("⏳ Waiting %s for the LLM rate limit\n", delay.Round(time.Millisecond))
+	return sleepWithContext(ctx, delay)
+}
+
+// llmRateLimiters are shared by the providers of the same name, so every request to a provider
+// counts against its llm_requests_per_minute
+var (
+	llmRateLimitersMu sync.Mutex
+	llmRateLimiters   = map[string]*rateLimiter{}
+)
+
+// llmRateLimiter returns the limiter of the provider, nil when llm_requests_per_minute is not set
+func llmRateLimiter(providerName string) *rateLimiter {
+	requestsPerMinute := getEnvInt("llm_requests_per_minute", 0)
+	if requestsPerMinute <= 0 {
+		return nil
+	}
+
+	llmRateLimitersMu.Lock()
+	defer llmRateLimitersMu.Unlock()
+	limiter, ok := llmRateLimiters[providerName]
+	if !ok {
+		limiter = newRateLimiter(requestsPerMinute)
+		llmRateLimiters[providerName] = limiter
+	}
+	return limiter
+}
+
+// rateLimitedProvider spaces the requests of provider with limiter, and repeats those rejected
+// with a 429 or failing with a 5xx, honoring the Retry-After of the provider.
+type rateLimitedProvider struct {
+	provider   llmProvider
+	limiter    *rateLimiter
+	maxRetries int
+}
+
+func newRateLimitedProvider(providerName string, provider llmProvider) rateLimitedProvider {
+	maxRetries := getEnvInt("llm_max_retries", defaultLLMMaxRetries)
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	return rateLimitedProvider{provider: provider, limiter: llmRateLimiter(providerName), maxRetries: maxRetries}
+}
+
+func (p rateLimitedProvider) Analyze(ctx context.Context, prompt string) (string, error) {
+	var lastErr error
+	for attempt := 0; attempt <= p.maxRetries; attempt++ {
+		if attempt > 0 {
+			delay := retryDelay(lastErr, attempt)
+			logWarnf("⏳ Retrying LLM request in %s (attempt %d/%d): %v\n", delay, attempt, p.maxRetries, lastErr)
+			if !sleepWithContext(ctx, delay) {
+				return "", ctx.Err()
+			}
+		}
+		if p.limiter != nil && !p.limiter.wait(ctx) {
+			return "", ctx.Err()
+		}
+
+		answer, err := p.provider.Analyze(ctx, prompt)
+		if err == nil {
+			return answer, nil
+		}
+
+		// Invalid keys or requests won't recover by retrying, and a timed out completion would likely time out again
+		if !isRetryable(err) {
+			return "", err
+		}
+		lastErr = err
+	}
+
+	return "", fmt.Errorf("giving up after %d retries: %v", p.maxRetries, lastErr)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// logLevel controls how much diagnostic output the step prints, set with the log_level input
+type logLevel int
+
+const (
+	// logLevelQuiet only prints warnings, errors and the final summary
+	logLevelQuiet logLevel = iota
+	logLevelNormal
+	// logLevelVerbose adds per-chunk and per-step details
+	logLevelVerbose
+)
+
+var currentLogLevel = logLevelNormal
+
+// diagnosticOutput receives everything but the errors, stderr when the logs themselves are written to stdout
+var diagnosticOutput io.Writer = os.Stdout
+
+func parseLogLevel(value string) logLevel {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "quiet":
+		return logLevelQuiet
+	case "verbose":
+		return logLevelVerbose
+	case "", "normal":
+		return logLevelNormal
+	default:
+		logWarnf("Warning: unknown log_level %q, using normal\n", value)
+		return logLevelNormal
+	}
+}
+
+// logVerbosef prints details only useful when debugging the step
+func logVerbosef(format string, args ...interface{}) {
+	if currentLogLevel >= logLevelVerbose {
+		fmt.Fprintf(diagnosticOutput, format, args...)
+	}
+}
+
+// logInfof prints progress information, hidden in quiet mode
+func logInfof(format string, args ...interface{}) {
+	if currentLogLevel >= logLevelNormal {
+		fmt.Fprintf(diagnosticOutput, format, args...)
+	}
+}
+
+// logSummaryf prints the final summary, shown at every log level
+func logSummaryf(format string, args ...interface{}) {
+	fmt.Fprintf(diagnosticOutput, format, args...)
+}
+
+// logWarnf prints warnings, shown at every log level
+func logWarnf(format string, args ...interface{}) {
+	fmt.Fprintf(diagnosticOutput, format, args...)
+}
+
+// logErrorf prints errors to stderr, shown at every log level
+func logErrorf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, args...)
+}
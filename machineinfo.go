@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// machineInfoCommandTimeout bounds the commands asked for the OS and Xcode versions
+const machineInfoCommandTimeout = 5 * time.Second
+
+// machineInfoField is a fact about the machine running the build, e.g. its stack or Xcode version
+type machineInfoField struct {
+	Name  string
+	Value string
+}
+
+// machineInfo is the machine info of include_machine_info, set after the collection
+var machineInfo []machineInfoField
+
+// machineInfoEnvVars are the Bitrise environment variables describing the build machine, the first set one is used
+var machineInfoEnvVars = []struct {
+	name string
+	keys []string
+}{
+	{"Stack", []string{"BITRISE_STACK_ID"}},
+	{"Stack revision", []string{"BITRISE_STACK_REV_ID", "BITRISE_OSX_STACK_REV_ID"}},
+	{"Machine type", []string{"BITRISE_MACHINE_TYPE_ID"}},
+}
+
+// collectMachineInfo describes the machine running the step, which is the build machine when the step runs
+// in the analyzed build: its Bitrise stack and machine type, OS version, CPU architecture and Xcode version.
+// Toolchain errors are often explained by those, e.g. an Apple Silicon machine or a new Xcode.
+func collectMachineInfo() []machineInfoField {
+	var fields []machineInfoField
+	for _, env := range machineInfoEnvVars {
+		for _, key := range env.keys {
+			if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+				fields = append(fields, machineInfoField{Name: env.name, Value: value})
+				break
+			}
+		}
+	}
+
+	if osVersion := osVersion(); osVersion != "" {
+		fields = append(fields, machineInfoField{Name: "OS", Value: osVersion})
+	}
+	fields = append(fields, machineInfoField{Name: "Architecture", Value: fmt.Sprintf("%s/%s, %d CPUs", runtime.GOOS, runtime.GOARCH, runtime.NumCPU())})
+
+	if runtime.GOOS == "darwin" {
+		// "Xcode 15.0.1\nBuild version 15A507"
+		if xcode := commandOutput("xcodebuild", "-version"); xcode != "" {
+			fields = append(fields, machineInfoField{Name: "Xcode", Value: strings.Join(strings.Fields(xcode), " ")})
+		}
+	}
+	return fields
+}
+
+// osVersion returns the name and version of the OS, e.g. "macOS 14.5" or "Ubuntu 22.04.4 LTS"
+func osVersion() string {
+	switch runtime.GOOS {
+	case "darwin":
+		if version := commandOutput("sw_vers", "-productVersion"); version != "" {
+			return "macOS " + version
+		}
+	case "linux":
+		content, err := os.ReadFile("/etc/os-release")
+		if err != nil {
+			return ""
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if strings.HasPrefix(line, "PRETTY_NAME=") {
+				return strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), `"'`)
+			}
+		}
+	}
+	return ""
+}
+
+// commandOutput runs the command and returns its trimmed output, empty when it is missing or fails
+func commandOutput(name string, args ...string) string {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), machineInfoCommandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, path, args...).Output()
+	if err != nil {
+		logVerbosef("Could not run %s: %v\n", name, err)
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// machineInfoHeader formats the machine info as the header of the text output
+func machineInfoHeader(fields []machineInfoField) string {
+	if len(fields) == 0 {
+		return ""
+	}
+
+	var header strings.Builder
+	header.WriteString("=== Machine info ===\n")
+	for _, field := range fields {
+		header.WriteString(fmt.Sprintf("%s: %s\n", field.Name, field.Value))
+	}
+	header.WriteString("\n")
+	return header.String()
+}
@@ -1,15 +1,30 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
 )
 
 // Updated struct to match the actual API response format
@@ -30,169 +45,1573 @@ type BitriseYAMLResponse struct {
 	Data string `json:"data"`
 }
 
+// BitriseBuildListResponse is the response of the builds list endpoint, only the fields used to resolve a build number
+type BitriseBuildListResponse struct {
+	Data []BitriseBuild `json:"data"`
+}
+
+type BitriseBuild struct {
+	Slug        string `json:"slug"`
+	BuildNumber int    `json:"build_number"`
+}
+
+const gzipSuffix = ".gz"
+
+// Exit codes of the step, so wrapping automation can tell a bad configuration from an unreachable API or a build
+// that didn't finish in time. exitError is for everything else, e.g. the output file can't be written.
+const (
+	exitSuccess     = 0
+	exitError       = 1
+	exitConfigError = 2
+	exitAPIError    = 3
+	exitTimeout     = 4
+	// exitAborted is for aborted builds, whose logs are written but not analyzed
+	exitAborted = 5
+)
+
+// exitCodeError is a failure ending the step with code. Helpers return it to run, which returns the code
+// to main, so the deferred cleanups of run still happen.
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e exitCodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e exitCodeError) Unwrap() error {
+	return e.err
+}
+
+// exitCodeOf returns the exit code of an exitCodeError, exitError for other errors
+func exitCodeOf(err error) int {
+	var codeErr exitCodeError
+	if errors.As(err, &codeErr) {
+		return codeErr.code
+	}
+	return exitError
+}
+
+// completionMarker is the last line of complete text logs
+const completionMarker = "=== AI ANALYZER LOGS COMPLETE ==="
+
+// failedStepFileName is written next to the output file when write_failed_step_file is enabled
+const failedStepFileName = "failed_step.log"
+
+// maxBackoff caps the exponential backoff between API retries
+const maxBackoff = 30 * time.Second
+
+const defaultHTTPTimeoutSeconds = 30
+
+// defaultRawLogDownloadTimeoutSeconds bounds the download of the raw log of an archived build, which can be hundreds of MB
+const defaultRawLogDownloadTimeoutSeconds = 600
+
+const defaultAPIBaseURL = "https://api.bitrise.io"
+
+// defaultPollInterval is used when the interval input is empty or invalid, minPollInterval keeps
+// a typo like 0 from polling the API in a busy loop
+const (
+	defaultPollInterval = 5 * time.Second
+	minPollInterval     = time.Second
+)
+
+// defaultPollJitter spreads the polls of concurrent steps by ±20% of the interval
+const defaultPollJitter = 0.2
+
+// defaultMaxWaitSeconds bounds how long the log polling loop may run
+const defaultMaxWaitSeconds = 1800
+
+// defaultExtraLinesAfterTarget is how many lines are collected after the target message,
+// since the error context usually follows it
+const defaultExtraLinesAfterTarget = 20
+
+// httpDoer sends HTTP requests. The API calls take it instead of using the client directly,
+// so they can be pointed at another client, e.g. one talking to an httptest.Server.
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// httpClient is shared by all API calls so connections are pooled across polling iterations
+var httpClient = &http.Client{Timeout: defaultHTTPTimeoutSeconds * time.Second}
+
+// newHTTPClient builds the shared client. The timeout covers the whole request including reading the body.
+func newHTTPClient() (*http.Client, error) {
+	timeoutSeconds := getEnvInt("http_timeout_seconds", defaultHTTPTimeoutSeconds)
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultHTTPTimeoutSeconds
+	}
+
+	// Requests go through HTTP_PROXY/HTTPS_PROXY (honoring NO_PROXY), unless proxy_url overrides them
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxyURL := strings.TrimSpace(getInput("proxy_url")); proxyURL != "" {
+		parsed, err := neturl.Parse(proxyURL)
+		if err != nil || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid proxy_url %q", proxyURL)
+		}
+		transport.Proxy = http.ProxyURL(parsed)
+		logInfof("Using proxy %s\n", parsed.Redacted())
+	}
+
+	if caCertFile := strings.TrimSpace(getInput("ca_cert_file")); caCertFile != "" {
+		rootCAs, err := loadCACertPool(caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+		logInfof("Trusting the additional CA certificates from %s\n", caCertFile)
+	}
+
+	return &http.Client{Transport: transport, Timeout: time.Duration(timeoutSeconds) * time.Second}, nil
+}
+
+// loadCACertPool adds the PEM certificates of the file to the system pool, for TLS-intercepting proxies with an internal CA.
+func loadCACertPool(caCertFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate file: %v", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		logWarnf("⚠️  Warning: could not load the system certificate pool, only trusting %s: %v\n", caCertFile, err)
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", caCertFile)
+	}
+	return pool, nil
+}
+
+// apiURL builds a Bitrise API v0.1 URL for the given path, e.g. "/apps/<slug>/bitrise.yml".
+// The base URL can point at a Bitrise Enterprise instance or a mock server, with or without a trailing slash.
+func apiURL(path string) string {
+	baseURL := strings.TrimSpace(getInput("bitrise_api_base_url"))
+	if baseURL == "" {
+		baseURL = defaultAPIBaseURL
+	}
+
+	return strings.TrimRight(baseURL, "/") + "/v0.1" + path
+}
+
 func main() {
+	// Subcommands are developer tools run locally, not part of the step
+	if len(os.Args) > 1 && os.Args[1] == filterCommandName {
+		os.Exit(runFilterCommand(os.Args[2:]))
+	}
+
+	os.Exit(run())
+}
+
+// run runs the step and returns its exit code
+func run() int {
 	// Define command-line flags
-	token := os.Getenv("BITRISE_API_TOKEN")
-	appSlug := os.Getenv("BITRISE_APP_SLUG")
-	buildSlug := os.Getenv("BITRISE_BUILD_SLUG")
-	interval, _ := strconv.Atoi(os.Getenv("interval"))
-	outputFile := os.Getenv("output_file")
+	configFlag := flag.String("config", "", "JSON or YAML file with the step inputs, environment variables override its values")
 	flag.Parse()
 
-	targetLogMessage := "AI STOPS HERE WITH THE LOGS"
-	fmt.Printf(targetLogMessage)
-	fmt.Printf("Token is %s\n", token)
-	fmt.Printf("App slug is %s\n", appSlug)
-	fmt.Printf("Build slug is %s\n", buildSlug)
-	fmt.Printf("Interval is %d\n", interval)
-	fmt.Printf("Output file is %s\n", outputFile)
+	// A config file replaces setting every input as an environment variable, e.g. for local runs
+	configPath := *configFlag
+	if configPath == "" {
+		configPath = os.Getenv("config")
+	}
+	if configPath != "" {
+		config, err := loadConfig(configPath)
+		if err != nil {
+			logErrorf("Error loading config: %v\n", err)
+			return exitConfigError
+		}
+		stepConfig = config
+	}
+
+	token := getInput("BITRISE_API_TOKEN")
+	appSlug := getInput("BITRISE_APP_SLUG")
+	buildSlug := getInput("BITRISE_BUILD_SLUG")
+	interval := parsePollInterval(getInput("interval"))
+	// output_file is the older name of optimized_output_file
+	outputFile := getInput("optimized_output_file")
+	if outputFile == "" {
+		outputFile = getInput("output_file")
+	}
+	// The logs written to stdout are only printed at the end, nothing is streamed to a file while collecting
+	stdoutOutput = outputFile == stdoutOutputFile || getInput("output_to_stdout") == "true"
+	logsDestination := outputFile
+	if stdoutOutput {
+		diagnosticOutput = os.Stderr
+		logsDestination = stdoutOutputFile
+		outputFile = ""
+	}
+	rawOutputFile := getInput("raw_output_file")
+	// Compressed output goes to <output_file>.gz, downstream steps must decompress it
+	if getInput("compress_output") == "true" {
+		if outputFile != "" && !isGzipPath(outputFile) {
+			outputFile += gzipSuffix
+		}
+		if rawOutputFile != "" && !isGzipPath(rawOutputFile) {
+			rawOutputFile += gzipSuffix
+		}
+	}
+	maxWaitSeconds := getEnvInt("max_wait_seconds", defaultMaxWaitSeconds)
+	extraLinesAfterTarget := getEnvInt("extra_lines_after_target", defaultExtraLinesAfterTarget)
+	includeWorkflowContext := getInput("include_workflow_context") == "true"
+	stripANSIEnabled := getInput("strip_ansi") != "false"
+	inputLogFile := getInput("input_log_file")
+	maxOutputBytes := getEnvInt("max_output_bytes", 0)
+	pollJitter := getEnvFloat("poll_jitter", defaultPollJitter)
+
+	currentLogLevel = parseLogLevel(getInput("log_level"))
+	// Secrets are masked as the logs are collected, before anything is written or sent to the AI
+	loadRedactionPatterns()
+	if err := loadFilterPatternsFile(); err != nil {
+		logErrorf("Error loading filter patterns: %v\n", err)
+		return exitConfigError
+	}
+
+	if stepConfig.Path != "" {
+		logInfof("Loaded %d inputs from %s\n", len(stepConfig.Values), stepConfig.Path)
+	}
+
+	// Cancel in-flight requests when CI tears the step down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// A mounted token file keeps the token out of the environment of child processes
+	if tokenFile := getInput("bitrise_api_token_file"); tokenFile != "" {
+		fileToken, err := readTokenFile(tokenFile)
+		if err != nil {
+			logErrorf("Error reading API token file: %v\n", err)
+			return exitConfigError
+		}
+		token = fileToken
+		logInfof("Using the API token from %s\n", tokenFile)
+	}
+
+	client, err := newHTTPClient()
+	if err != nil {
+		logErrorf("Error configuring the HTTP client: %v\n", err)
+		return exitConfigError
+	}
+	httpClient = client
+
+	// Automation often only knows the build number, look up its slug
+	if buildNumber := strings.TrimSpace(getInput("bitrise_build_number")); buildSlug == "" && buildNumber != "" && inputLogFile == "" {
+		number, err := strconv.Atoi(buildNumber)
+		if err != nil {
+			logErrorf("Error: invalid bitrise_build_number %q\n", buildNumber)
+			return exitConfigError
+		}
+		buildSlug, err = resolveBuildSlug(ctx, httpClient, token, appSlug, number)
+		if err != nil {
+			logErrorf("Error resolving build number %d: %v\n", number, err)
+			return exitAPIError
+		}
+		logInfof("Resolved build number %d to build slug %s\n", number, buildSlug)
+	}
+
+	// The step list of the build types steps by their step ID, which custom step titles don't reveal,
+	// and its workflow selects the last successful build to compare with
+	fetchSteps := getInput("fetch_build_steps") != "false"
+	diffAgainstLastSuccess := getInput("diff_against_last_success") == "true"
+	buildWorkflow := ""
+	if inputLogFile == "" && (fetchSteps || diffAgainstLastSuccess) {
+		details, err := fetchBuildDetails(ctx, httpClient, token, appSlug, buildSlug)
+		if err != nil {
+			logWarnf("⚠️  Warning: could not fetch the build details, step types are detected from the log titles: %v\n", err)
+		} else {
+			buildWorkflow = details.TriggeredWorkflow
+			if fetchSteps {
+				buildSteps = details.Steps
+				logVerbosef("Fetched the metadata of %d build steps\n", len(buildSteps))
+			}
+		}
+	}
+
+	stats := &collectionStats{startTime: time.Now()}
+
+	if maxWaitSeconds <= 0 {
+		maxWaitSeconds = defaultMaxWaitSeconds
+	}
+	maxWait := time.Duration(maxWaitSeconds) * time.Second
 
-	// Set up output destination
+	// Without a target message, collection only stops once the build log is archived
+	targetLogMessage := getInput("target_log_message")
+	logInfof("Target log message is %q\n", targetLogMessage)
+	logInfof("Token is %s\n", maskToken(token))
+	logInfof("App slug is %s\n", appSlug)
+	logInfof("Build slug is %s\n", buildSlug)
+	logInfof("Interval is %s\n", interval)
+	if strategy := getInput("poll_strategy"); strategy != "" {
+		logInfof("Polling strategy is %s\n", strategy)
+	}
+	if stdoutOutput {
+		logInfof("Output is written to stdout\n")
+	} else {
+		logInfof("Output file is %s\n", outputFile)
+	}
+	if rawOutputFile != "" {
+		logInfof("Raw output file is %s\n", rawOutputFile)
+	}
+	logInfof("Max wait is %s\n", maxWait)
+
+	// The output file is only replaced once logs arrive, fail early when it can't be written at all
 	if outputFile != "" {
-		file, err := os.Create(outputFile)
+		if err := checkFileWritable(outputFile); err != nil {
+			logErrorf("Error creating output file: %v\n", err)
+			return exitError
+		}
+	}
+
+	// The streaming parser filters the steps while collecting, for builds whose log doesn't fit in memory
+	streamingParse := getInput("streaming_parse") == "true"
+	// A log uploaded as a build artifact replaces the console log of the chunked log API
+	artifactName := strings.TrimSpace(getInput("artifact_name"))
+	if inputLogFile != "" {
+		artifactName = ""
+	}
+	if artifactName != "" && streamingParse {
+		logInfof("streaming_parse is not used for the artifact log, it is downloaded whole\n")
+		streamingParse = false
+	}
+	stepsFilteredWhileCollecting = streamingParse
+
+	var collectedLogs string
+	var artifactLogs string
+	if artifactName != "" {
+		logInfof("Reading logs from the build artifact %s\n", artifactName)
+		artifactLogs, err = fetchArtifactLog(ctx, httpClient, token, appSlug, buildSlug, artifactName)
+		if err != nil {
+			logWarnf("⚠️  Warning: could not read the artifact %s, collecting the build log instead: %v\n", artifactName, err)
+			artifactName = ""
+		}
+	}
+	if artifactName != "" {
+		collectedLogs = cleanLogs(artifactLogs, stripANSIEnabled)
+		stats.source = "build artifact"
+		logCompleteness = logCompletenessArtifact
+	} else if inputLogFile != "" && streamingParse {
+		logInfof("Reading logs from %s, skipping the Bitrise API\n", inputLogFile)
+		collectedLogs, err = readLogFileStreaming(inputLogFile, rawOutputFile, stripANSIEnabled, stats)
+		if err != nil {
+			logErrorf("Error reading input log file: %v\n", err)
+			return exitConfigError
+		}
+		stats.source = "input log file"
+		logCompleteness = logCompletenessInputFile
+	} else if inputLogFile != "" {
+		// Dry-run mode: analyze a saved log without hitting the Bitrise API
+		logInfof("Reading logs from %s, skipping the Bitrise API\n", inputLogFile)
+		content, err := os.ReadFile(inputLogFile)
+		if err != nil {
+			logErrorf("Error reading input log file: %v\n", err)
+			return exitConfigError
+		}
+		collectedLogs = string(content)
+		stats.source = "input log file"
+		logCompleteness = logCompletenessInputFile
+		collectedLogs = cleanLogs(collectedLogs, stripANSIEnabled)
+	} else {
+		collectedLogs, err = collectBuildLogs(ctx, collectorOptions{
+			token:                 token,
+			appSlug:               appSlug,
+			buildSlug:             buildSlug,
+			outputFile:            outputFile,
+			interval:              interval,
+			maxWait:               maxWait,
+			targetLogMessage:      targetLogMessage,
+			extraLinesAfterTarget: extraLinesAfterTarget,
+			stripANSI:             stripANSIEnabled,
+			stats:                 stats,
+			client:                httpClient,
+			maxOutputBytes:        maxOutputBytes,
+			jitter:                pollJitter,
+			checkpointFile:        getInput("checkpoint_file"),
+			streamingParse:        streamingParse,
+			rawOutputFile:         rawOutputFile,
+			completionMode:        parseCompletionMode(getInput("completion_mode"), targetLogMessage),
+			fastMode:              getInput("fast_mode") == "true",
+			fastModeLinesAfter:    getEnvInt("fast_mode_lines_after", defaultFastModeLinesAfter),
+			checkBuildStatus:      getInput("check_build_status") != "false",
+			pollStrategy:          getInput("poll_strategy"),
+			maxPollInterval:       time.Duration(getEnvInt("poll_max_interval", int(defaultMaxPollInterval/time.Second))) * time.Second,
+		})
+		if err != nil {
+			logErrorf("Error collecting logs: %v\n", err)
+			return exitCodeOf(err)
+		}
+	}
+
+	// The complete log is kept for audit, next to the optimized one fed to the AI.
+	// The streaming parser already wrote it while collecting.
+	if rawOutputFile != "" {
+		if !streamingParse {
+			if err := writeLogFile(rawOutputFile, collectedLogs); err != nil {
+				logErrorf("Error writing raw logs: %v\n", err)
+				return exitError
+			}
+			logInfof("Saved %d bytes of raw logs to %s\n", len(collectedLogs), rawOutputFile)
+		}
+		if err := exportEnvVar("AI_ANALYZER_RAW_LOG_PATH", absPath(rawOutputFile)); err != nil {
+			logWarnf("⚠️  Warning: could not export AI_ANALYZER_RAW_LOG_PATH: %v\n", err)
+		}
+	}
+
+	// The failed steps are compared with the same steps of the last successful build of the workflow
+	if diffAgainstLastSuccess && inputLogFile == "" {
+		loadLastSuccessLogs(ctx, httpClient, token, appSlug, buildWorkflow, stripANSIEnabled)
+	}
+
+	// Narrow the collected logs down to what matters for the analysis
+	cleanedLogs := analyzer.CollapseCarriageReturns(collectedLogs)
+	optimizedLogs := optimizeLogsForAnalysis(cleanedLogs)
+	// Infrastructure failures shouldn't be blamed on the code, pipelines can retry those builds instead
+	failureClass = classifyFailure(cleanedLogs)
+	// An aborted build ends abruptly, there is no issue the analysis could find
+	buildAborted := isBuildAborted(stats.buildStatus, cleanedLogs)
+	if buildAborted {
+		failureClass = failureClassAborted
+	}
+	logInfof("Failure class: %s\n", failureClass)
+	// The build machine often explains toolchain errors, it heads the output and is given to the analysis
+	if getInput("include_machine_info") == "true" {
+		machineInfo = collectMachineInfo()
+	}
+	if getInput("output_format") == "json" {
+		err = writeJSONOutput(logsDestination, buildOutputDocument(optimizedLogs, maxOutputBytes))
+	} else {
+		// The header is added after the cap, the tail kept by the cap would drop it
+		err = writeLogFile(logsDestination, withCompletionMarker(machineInfoHeader(machineInfo)+capOutputSize(optimizedLogs, maxOutputBytes)))
+	}
+	if err != nil {
+		logErrorf("Error writing optimized logs: %v\n", err)
+		return exitError
+	}
+
+	// A small categorized summary lets dashboards aggregate failures without re-parsing the logs
+	if issuesFile := getInput("issues_output_file"); issuesFile != "" {
+		if err := writeIssuesSummary(issuesFile, optimizedLogs); err != nil {
+			logWarnf("⚠️  Warning: %v\n", err)
+		}
+	}
+
+	logSummaryf("\nSaved %d bytes of optimized logs (collected %d bytes)\n", len(optimizedLogs), len(collectedLogs))
+	stats.recordLogs(collectedLogs, optimizedLogs)
+	stats.print()
+
+	// The collected logs are flushed, don't start anything new while being torn down
+	if ctx.Err() != nil {
+		logInfof("Step was cancelled, skipping the remaining work\n")
+		return collectionExitCode()
+	}
+
+	// The workflow definition helps the analysis make sense of the failing logs
+	workflowYAML := ""
+	if includeWorkflowContext && inputLogFile != "" {
+		logInfof("Skipping workflow context, logs were read from input_log_file\n")
+	} else if includeWorkflowContext {
+		// Logs printed to stdout have no directory to save bitrise.yml next to, it is only given to the analysis
+		workflowDir := ""
+		if outputFile != "" {
+			workflowDir = filepath.Dir(outputFile)
+		}
+		workflowYAML, err = saveWorkflowContext(ctx, httpClient, workflowDir, token, appSlug)
 		if err != nil {
-			fmt.Printf("Error creating output file: %v\n", err)
-			os.Exit(1)
+			logWarnf("⚠️  Warning: could not save workflow context: %v\n", err)
+		}
+	}
+
+	// Let downstream steps find the collected logs
+	if outputFile != "" {
+		exportLogFileOutputs(outputFile)
+	}
+
+	if err := exportEnvVar("AI_ANALYZER_FAILURE_CLASS", failureClass); err != nil {
+		logWarnf("⚠️  Warning: could not export AI_ANALYZER_FAILURE_CLASS: %v\n", err)
+	}
+	if err := exportEnvVar("AI_ANALYZER_LOG_COMPLETENESS", logCompleteness); err != nil {
+		logWarnf("⚠️  Warning: could not export AI_ANALYZER_LOG_COMPLETENESS: %v\n", err)
+	}
+
+	// Some users only feed the failing step to the AI, give them its logs on their own
+	if getInput("write_failed_step_file") == "true" && outputFile != "" {
+		if err := saveFailedStepLogs(filepath.Dir(outputFile), cleanedLogs); err != nil {
+			logWarnf("⚠️  Warning: could not save the failed step logs: %v\n", err)
+		}
+	}
+
+	if buildAborted {
+		logSummaryf("🛑 Build was aborted, skipping AI analysis\n")
+		return exitAborted
+	}
+
+	// The AI analysis is optional, the collected logs are useful on their own
+	if llmAPIKey() == "" {
+		logInfof("No LLM API key set, skipping AI analysis\n")
+		return collectionExitCode()
+	}
+	if err := runAnalysis(ctx, optimizedLogs, workflowYAML, getInput("analysis_output_file")); err != nil {
+		logErrorf("Error running AI analysis: %v\n", err)
+		return exitAPIError
+	}
+	return collectionExitCode()
+}
+
+// collectionExitCode is exitTimeout when the build didn't finish within max_wait_seconds, whose logs are still
+// written and analyzed, exitSuccess otherwise
+func collectionExitCode() int {
+	if logCompleteness == logCompletenessTimedOut {
+		return exitTimeout
+	}
+	return exitSuccess
+}
+
+// collectorOptions configures how the build logs are polled from the Bitrise API
+type collectorOptions struct {
+	token                 string
+	appSlug               string
+	buildSlug             string
+	outputFile            string
+	interval              time.Duration
+	maxWait               time.Duration
+	targetLogMessage      string
+	extraLinesAfterTarget int
+	stripANSI             bool
+	stats                 *collectionStats
+	client                httpDoer
+	// maxOutputBytes caps the streamed output file to a rolling tail of the logs, 0 means no cap
+	maxOutputBytes int
+	// jitter randomizes the polling interval by up to this fraction, e.g. 0.2 for ±20%
+	jitter float64
+	// checkpointFile persists the progress, so a retried step resumes where the previous attempt stopped
+	checkpointFile string
+	// streamingParse filters each step as it is parsed instead of keeping the whole log in memory
+	streamingParse bool
+	// rawOutputFile receives the raw logs while collecting, only used with streamingParse
+	rawOutputFile string
+	// completionMode selects whether the archived log, the target message or either stops the collection
+	completionMode string
+	// fastMode stops the collection fastModeLinesAfter lines after the first error, see firstErrorPattern
+	fastMode           bool
+	fastModeLinesAfter int
+	// checkBuildStatus polls the build status, which tells when the build finished instead of the log archival
+	checkBuildStatus bool
+	// pollStrategy is fixed (interval between all polls) or adaptive, up to maxPollInterval, see pollScheduler
+	pollStrategy    string
+	maxPollInterval time.Duration
+	// clock times the polls and the max wait, the wall clock when nil
+	clock clock
+}
+
+// defaultFastModeLinesAfter is the context collected after the first error in fast mode
+const defaultFastModeLinesAfter = 50
+
+// firstErrorPattern matches the lines clearly reporting a failure, which stop the collection in fast mode:
+// compiler errors, failed builds, tasks and tests, and non-zero exit codes
+var firstErrorPattern = regexp.MustCompile(`(?m)(?:^|\s)(?:fatal )?error: |\bFAILED\b|^\s*--- FAIL: |(?i:exit (?:code|status):? *[1-9][0-9]*)`)
+
+// completion_mode values
+const (
+	completionModeEither       = "either"
+	completionModeArchiveOnly  = "archive_only"
+	completionModeSentinelOnly = "sentinel_only"
+)
+
+// parseCompletionMode validates completion_mode, sentinel_only needs a target message to stop on
+func parseCompletionMode(value, targetLogMessage string) string {
+	mode := strings.ToLower(strings.TrimSpace(value))
+	switch mode {
+	case "":
+		return completionModeEither
+	case completionModeEither, completionModeArchiveOnly:
+		return mode
+	case completionModeSentinelOnly:
+		if targetLogMessage == "" {
+			logWarnf("⚠️  Warning: completion_mode is sentinel_only but target_log_message is empty, using %s\n", completionModeEither)
+			return completionModeEither
 		}
-		defer file.Close()
+		return mode
+	default:
+		logWarnf("⚠️  Warning: unknown completion_mode %q, using %s\n", value, completionModeEither)
+		return completionModeEither
+	}
+}
+
+// collectBuildLogs polls the build log until the build finishes, enough lines were collected after
+// the target message, or the max wait is exceeded, and returns the collected logs.
+// completionMode can restrict the first two conditions to one of them.
+// Failing API requests and output writes end the collection with an exitCodeError, keeping the checkpoint.
+func collectBuildLogs(ctx context.Context, opts collectorOptions) (string, error) {
+	token, appSlug, buildSlug := opts.token, opts.appSlug, opts.buildSlug
+	outputFile := opts.outputFile
+	targetLogMessage := opts.targetLogMessage
+	// Only the finished build stops archive_only collection, the target message is not looked for
+	if opts.completionMode == completionModeArchiveOnly {
+		targetLogMessage = ""
 	}
+	stopOnArchive := opts.completionMode != completionModeSentinelOnly
+	scheduler := newPollScheduler(opts.pollStrategy, opts.interval, opts.maxPollInterval)
+	clk := opts.clock
+	if clk == nil {
+		clk = realClock{}
+	}
+	warnedFinishedBeforeTarget := false
 
-	// Initialize position for log fetching
-	position := 0
+	// Initialize the cursor for log fetching
+	var cursor logCursor
+	// Highest chunk position already written, the API can return chunks overlapping a previous poll
+	lastWrittenPosition := -1
 	foundTargetMessage := false
+	linesAfterTarget := 0
+	foundFirstError := false
+	linesAfterError := 0
 	isFinished := false
+	// The final chunks can arrive on the poll after the build finished or the log was archived, so it is fetched once more
+	drainedAfterFinish := false
+	// The streaming parser keeps only the filtered steps, the raw logs are not held in memory
+	newCollector := func() logCollector {
+		if opts.streamingParse {
+			return newStreamingCollector(opts.rawOutputFile)
+		}
+		return &strings.Builder{}
+	}
+	collectedLogs := newCollector()
+	// Chunks can end mid-line, only complete lines are collected so step boundaries stay intact
+	var pendingLines analyzer.LineBuffer
+	lastLineOpen := false
+	// The streamed logs are buffered and written to the output file once per poll
+	outputSink := newStreamedOutputSink(outputFile, opts.maxOutputBytes)
+	cancelled := false
+	// failure ends the collection, the logs collected after it are dropped
+	var failure error
+	// Length of the checkpoint logs, saved with the checkpoint position
+	checkpointLogBytes := 0
+	startTime := clk.Now()
+
+	// A retried step picks up the logs and position of the previous attempt on the same build
+	if opts.checkpointFile != "" {
+		if checkpoint, previousLogs, ok := loadCheckpoint(opts.checkpointFile, buildSlug); ok {
+			logInfof("♻️  Resuming from checkpoint %s at %s\n", opts.checkpointFile, logCursor{Position: checkpoint.Position, AfterTimestamp: checkpoint.AfterTimestamp})
+			cursor = logCursor{Position: checkpoint.Position, AfterTimestamp: checkpoint.AfterTimestamp}
+			lastWrittenPosition = checkpoint.Position
+			pendingLines.Partial = checkpoint.PendingLine
+			checkpointLogBytes = len(previousLogs)
+			collectedLogs.WriteString(previousLogs)
+		} else {
+			clearCheckpoint(opts.checkpointFile)
+		}
+	}
+
+	collectLines := func(lines string) {
+		if lines == "" || failure != nil {
+			return
+		}
+		lines = cleanLogs(lines, opts.stripANSI)
+		collectedLogs.WriteString(lines)
+		lastLineOpen = !strings.HasSuffix(lines, "\n")
+		if opts.checkpointFile != "" {
+			// Counted even when the write fails, the retried step then finds the logs short and starts over
+			checkpointLogBytes += len(lines)
+			if err := appendCheckpointLogs(opts.checkpointFile, lines); err != nil {
+				logWarnf("⚠️  Warning: could not write checkpoint logs: %v\n", err)
+			}
+		}
+
+		// Stream the raw logs to the output file while collecting, it is replaced
+		// by the optimized logs at the end. Without an output file only the optimized logs are printed.
+		if err := outputSink.Write(lines); err != nil {
+			failure = exitCodeError{code: exitError, err: fmt.Errorf("failed to write logs: %v", err)}
+			return
+		}
+
+		if foundTargetMessage {
+			// Count the context lines arriving after the target
+			linesAfterTarget += strings.Count(lines, "\n")
+		} else if idx := strings.Index(lines, targetLogMessage); targetLogMessage != "" && idx != -1 {
+			// Just found the target
+			foundTargetMessage = true
+			linesAfterTarget = strings.Count(lines[idx+len(targetLogMessage):], "\n")
+			logInfof("\nFound target message. Collecting %d more lines...\n", opts.extraLinesAfterTarget)
+		}
+
+		if !opts.fastMode {
+			return
+		}
+		if foundFirstError {
+			linesAfterError += strings.Count(lines, "\n")
+		} else if loc := firstErrorPattern.FindStringIndex(lines); loc != nil {
+			foundFirstError = true
+			linesAfterError = strings.Count(lines[loc[1]:], "\n")
+			// The match can start with the newline ending the previous line, its end is on the error line
+			lineStart := strings.LastIndex(lines[:loc[1]], "\n") + 1
+			lineEnd := len(lines)
+			if end := strings.Index(lines[loc[1]:], "\n"); end != -1 {
+				lineEnd = loc[1] + end
+			}
+			logInfof("\n⚡ Fast mode found the first error, collecting %d more lines: %s\n", opts.fastModeLinesAfter, strings.TrimSpace(lines[lineStart:lineEnd]))
+		}
+	}
+
+	logInfof("Starting to fetch Bitrise build logs...")
+	logInfof("App: %s, Build: %s\n\n", appSlug, buildSlug)
+
+	// Continue fetching logs until the build is finished
+	for {
+		logInfof("🔄 Fetching logs from %s\n", cursor)
+		logResponse, err := fetchLogChunk(ctx, opts.client, token, appSlug, buildSlug, cursor, clk, startTime.Add(opts.maxWait))
+		if ctx.Err() != nil {
+			logWarnf("\n⚠️  Log collection cancelled, stopping with the logs collected so far.\n")
+			cancelled = true
+			logCompleteness = logCompletenessCancelled
+			break
+		}
+		if errors.Is(err, errRetryDeadline) {
+			logWarnf("\n⚠️  Warning: log fetch still failing after %s, stopping log collection with the logs collected so far: %v\n", opts.maxWait, err)
+			logCompleteness = logCompletenessTimedOut
+			break
+		}
+		if err != nil {
+			failure = exitCodeError{code: exitAPIError, err: fmt.Errorf("failed to fetch logs: %v", err)}
+			break
+		}
+
+		logInfof("📦 Received %d chunks, IsArchived: %t\n", len(logResponse.LogChunks), logResponse.IsArchived)
+		opts.stats.polls++
+		opts.stats.chunksFetched += len(logResponse.LogChunks)
+
+		// The build status is the authoritative finished signal, the log can be archived some time after
+		// the build finished. The archival is relied on when the status can't be fetched.
+		buildFinished := logResponse.IsArchived
+		if opts.checkBuildStatus {
+			status, err := fetchBuildStatus(ctx, opts.client, token, appSlug, buildSlug)
+			if err != nil {
+				logVerbosef("Could not fetch the build status, relying on the log archival: %v\n", err)
+			} else {
+				if status != opts.stats.buildStatus && status != buildStateRunning {
+					logInfof("🏁 Build finished with status: %s\n", status)
+				}
+				opts.stats.buildStatus = status
+				buildFinished = status != buildStateRunning
+			}
+		}
+
+		// Finished builds expose the complete log through a presigned URL, prefer it over the chunks
+		if logResponse.IsArchived && logResponse.ExpiringRawLogURL != "" && stopOnArchive {
+			logInfof("📥 Build log is archived, downloading the full raw log...\n")
+			// A capped output file keeps the rolling tail of the chunks instead of the whole raw log
+			rawLogFile := outputFile
+			if opts.maxOutputBytes > 0 {
+				rawLogFile = ""
+			}
+			if err := outputSink.Close(); err != nil {
+				failure = exitCodeError{code: exitError, err: fmt.Errorf("failed to write logs: %v", err)}
+				break
+			}
+			rawLog := newCollector()
+			rawLogOpen, err := streamRawLog(ctx, opts.client, logResponse.ExpiringRawLogURL, rawLogFile, opts.stripANSI, rawLog)
+			if err == nil {
+				// The raw log is complete, it replaces the chunks collected so far
+				collectedLogs = rawLog
+				lastLineOpen = rawLogOpen
+				pendingLines.Flush()
+				opts.stats.source = "archived raw log"
+				logCompleteness = logCompletenessFinishedArchived
+				logInfof("\nLog collection finished.")
+				break
+			}
+			logWarnf("⚠️  Failed to download raw log, falling back to log chunks: %v\n", err)
+		}
+
+		// Process each log chunk, in position order
+		newChunks := 0
+		sort.Slice(logResponse.LogChunks, func(i, j int) bool {
+			return logResponse.LogChunks[i].Position < logResponse.LogChunks[j].Position
+		})
+		if len(logResponse.LogChunks) > 0 {
+			var positions []string
+			for _, chunk := range logResponse.LogChunks {
+				positions = append(positions, strconv.Itoa(chunk.Position))
+			}
+			logVerbosef("📝 Processing chunks with positions: %s\n", strings.Join(positions, " "))
+
+			// Show first chunk content preview
+			firstChunk := logResponse.LogChunks[0]
+			chunkPreview := strings.ReplaceAll(firstChunk.Chunk, "\n", "\\n")
+			if len(chunkPreview) > 100 {
+				chunkPreview = chunkPreview[:100] + "..."
+			}
+			logVerbosef("🔍 First chunk (pos %d): %s\n", firstChunk.Position, chunkPreview)
+
+			for _, chunk := range logResponse.LogChunks {
+				// Skip chunks already consumed in a previous poll
+				if chunk.Position <= lastWrittenPosition {
+					logVerbosef("⏭️  Skipping already collected chunk (pos %d)\n", chunk.Position)
+					continue
+				}
+				lastWrittenPosition = chunk.Position
+				newChunks++
+
+				collectLines(pendingLines.Push(chunk.Chunk))
+
+				// Update the last position to the highest position we've seen
+				if chunk.Position > cursor.Position {
+					cursor.Position = chunk.Position
+				}
+			}
+		} else {
+			logWarnf("⚠️  No chunks received\n")
+		}
+		if err := flushCollectedLogs(outputSink, collectedLogs); err != nil && failure == nil {
+			failure = exitCodeError{code: exitError, err: err}
+		}
+		if failure != nil {
+			break
+		}
+		// Page through the log with the timestamp cursor, it only stops advancing at the end of the log
+		hasNextPage := logResponse.NextAfterTimestamp != "" && logResponse.NextAfterTimestamp != cursor.AfterTimestamp
+		if logResponse.NextAfterTimestamp != "" {
+			cursor.AfterTimestamp = logResponse.NextAfterTimestamp
+		}
+
+		// If the log is archived and there are no more pages, we can consider it finished
+		if opts.checkpointFile != "" {
+			checkpoint := logCheckpoint{BuildSlug: buildSlug, Position: cursor.Position, AfterTimestamp: cursor.AfterTimestamp, PendingLine: pendingLines.Partial, LogBytes: checkpointLogBytes}
+			if err := saveCheckpoint(opts.checkpointFile, checkpoint); err != nil {
+				logWarnf("⚠️  Warning: %v\n", err)
+			}
+		}
+
+		isFinished = buildFinished && !hasNextPage
+		// A finished build can still be delivering its last chunks, until its log is archived or a poll brings nothing new
+		if isFinished && !logResponse.IsArchived && newChunks > 0 {
+			logVerbosef("Build finished but its log is still growing, polling until it settles\n")
+			isFinished = false
+		}
+		if isFinished && !drainedAfterFinish {
+			drainedAfterFinish = true
+			logInfof("📥 Build finished, fetching once more for any remaining chunks...\n")
+			continue
+		}
+
+		// If build is finished, or enough lines were collected after the target, exit the loop
+		reachedTarget := foundTargetMessage && linesAfterTarget >= opts.extraLinesAfterTarget
+		reachedFirstError := foundFirstError && linesAfterError >= opts.fastModeLinesAfter
+		if (isFinished && stopOnArchive) || reachedTarget || reachedFirstError {
+			switch {
+			case isFinished:
+				logCompleteness = logCompletenessFinishedArchived
+			case reachedTarget:
+				logCompleteness = logCompletenessStoppedAtSentinel
+			default:
+				logCompleteness = logCompletenessStoppedAtFirstError
+			}
+			logInfof("\nLog collection finished.")
+			break
+		}
+		if isFinished && !warnedFinishedBeforeTarget {
+			logWarnf("⚠️  Warning: build finished without the target message, completion_mode is sentinel_only so waiting for it until max_wait_seconds\n")
+			warnedFinishedBeforeTarget = true
+		}
+
+		// The remaining pages of an archived log are fetched right away
+		if logResponse.IsArchived && hasNextPage {
+			continue
+		}
+
+		// Don't hang the CI step forever if the build never finishes
+		if clk.Now().Sub(startTime) >= opts.maxWait {
+			logWarnf("\n⚠️  Warning: build did not finish within %s, stopping log collection with the logs collected so far.\n", opts.maxWait)
+			logCompleteness = logCompletenessTimedOut
+			break
+		}
+
+		// Wait before polling again, with jitter so steps finishing together don't poll in lockstep
+		if !clk.Sleep(ctx, withJitter(scheduler.next(newChunks), opts.jitter)) {
+			logWarnf("\n⚠️  Log collection cancelled, stopping with the logs collected so far.\n")
+			cancelled = true
+			logCompleteness = logCompletenessCancelled
+			break
+		}
+	}
+
+	// The last line of the log may not end with a newline. A failed collection keeps it pending in the checkpoint
+	// instead, the retried step completes it with the next chunk.
+	if failure == nil {
+		collectLines(pendingLines.Flush())
+	}
+
+	// The first polls can return no chunks at all, don't settle for an empty log without one more try
+	if collectedLogs.Len() == 0 && !cancelled && failure == nil {
+		logWarnf("\n⚠️  Warning: no logs were collected, fetching the complete log once more...\n")
+		rawLog, archived, err := fetchCompleteLog(ctx, opts.client, token, appSlug, buildSlug)
+		switch {
+		case err != nil:
+			logWarnf("⚠️  Warning: could not fetch the complete log: %v\n", err)
+		case rawLog != "":
+			collectLines(rawLog)
+			opts.stats.source = "archived raw log"
+			if archived {
+				logCompleteness = logCompletenessFinishedArchived
+			}
+		}
+		if collectedLogs.Len() == 0 {
+			logWarnf("\n⚠️  ⚠️  ⚠️  Warning: no logs could be retrieved for build %s, the output will be empty ⚠️  ⚠️  ⚠️\n\n", buildSlug)
+		}
+	}
+
+	// An interrupted collection keeps its checkpoint for the retried step, with the partial line still pending on failure
+	if opts.checkpointFile != "" && (cancelled || failure != nil) {
+		checkpoint := logCheckpoint{BuildSlug: buildSlug, Position: cursor.Position, AfterTimestamp: cursor.AfterTimestamp, PendingLine: pendingLines.Partial, LogBytes: checkpointLogBytes}
+		if err := saveCheckpoint(opts.checkpointFile, checkpoint); err != nil {
+			logWarnf("⚠️  Warning: %v\n", err)
+		}
+	} else if opts.checkpointFile != "" {
+		clearCheckpoint(opts.checkpointFile)
+	}
+
+	opts.stats.receivedBytes = collectedLogs.Len()
+
+	// Streamed logs without the marker were cut off by the step being killed, or by a failure
+	if outputFile != "" && failure == nil {
+		marker := withCompletionMarker("")
+		if lastLineOpen {
+			marker = "\n" + marker
+		}
+		if err := outputSink.Write(marker); err != nil {
+			logWarnf("⚠️  Warning: could not write the completion marker: %v\n", err)
+		}
+	}
+	if err := outputSink.Close(); err != nil && failure == nil {
+		failure = exitCodeError{code: exitError, err: fmt.Errorf("failed to write logs: %v", err)}
+	}
+
+	logs := collectedLogs.String()
+	if failure != nil {
+		return "", failure
+	}
+	return logs, nil
+}
+
+// flushCollectedLogs writes the logs buffered during a poll to the output file, and to the raw output file
+// of the streaming parser, so a step killed between polls leaves complete files behind.
+func flushCollectedLogs(outputSink Sink, collectedLogs logCollector) error {
+	if err := flushSink(outputSink); err != nil {
+		return fmt.Errorf("failed to write logs: %v", err)
+	}
+	if collector, ok := collectedLogs.(*streamingCollector); ok {
+		collector.flushRawFile()
+	}
+	return nil
+}
+
+// newStreamedOutputSink returns the sink the collected logs are streamed to: the output file, replaced by the
+// first chunk and capped to maxOutputBytes when set. Without an output file the logs are not streamed, only the optimized logs are printed.
+func newStreamedOutputSink(outputFile string, maxOutputBytes int) Sink {
+	sinks := MultiSink{}
+	switch {
+	case outputFile == "":
+	case maxOutputBytes > 0:
+		sinks = append(sinks, NewCappedSink(outputFile, maxOutputBytes))
+	default:
+		sinks = append(sinks, newOutputSinkMode(outputFile, fileSinkReplace))
+	}
+	return sinks
+}
+
+// stepsFilteredWhileCollecting is set when the streaming parser filtered the steps while collecting them,
+// so the collected logs are not filtered a second time
+var stepsFilteredWhileCollecting bool
+
+// readLogFileStreaming reads the log file through the streaming parser, copying it to rawOutputFile when set.
+func readLogFileStreaming(path, rawOutputFile string, strip bool, stats *collectionStats) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	collector := newStreamingCollector(rawOutputFile)
+	cleaning := &logCleaningWriter{w: collector, strip: strip}
+	if _, err := io.Copy(cleaning, file); err != nil {
+		return "", err
+	}
+	if err := cleaning.flush(); err != nil {
+		return "", err
+	}
+
+	stats.receivedBytes = collector.Len()
+	return collector.String(), nil
+}
+
+// capOutputSize keeps the most recent logs within maxBytes, 0 means no cap.
+func capOutputSize(logs string, maxBytes int) string {
+	if maxBytes <= 0 || len(logs) <= maxBytes {
+		return logs
+	}
+
+	logWarnf("⚠️  Warning: optimized logs exceed max_output_bytes (%d > %d), keeping only the most recent logs\n", len(logs), maxBytes)
+	return analyzer.TailOfText(logs, maxBytes)
+}
+
+// readTokenFile reads an API token from a secret file, ignoring surrounding whitespace and the trailing newline.
+func readTokenFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file: %v", err)
+	}
+
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// exportLogFileOutputs exports the path and size of the log file as Bitrise output variables.
+func exportLogFileOutputs(outputFile string) {
+	logPath := absPath(outputFile)
+
+	if err := exportEnvVar("AI_ANALYZER_LOG_PATH", logPath); err != nil {
+		logWarnf("⚠️  Warning: could not export AI_ANALYZER_LOG_PATH: %v\n", err)
+		return
+	}
+	if info, err := os.Stat(logPath); err == nil {
+		if err := exportEnvVar("AI_ANALYZER_LOG_SIZE", strconv.FormatInt(info.Size(), 10)); err != nil {
+			logWarnf("⚠️  Warning: could not export AI_ANALYZER_LOG_SIZE: %v\n", err)
+		}
+	}
+}
+
+// saveFailedStepLogs writes the logs of the failed steps to failed_step.log and exports its path.
+// Nothing is written when no failed step is reported or it isn't found in the logs.
+func saveFailedStepLogs(outputDir, logs string) error {
+	failedSteps := failedStepsFromEnv()
+	if len(failedSteps) == 0 {
+		return nil
+	}
+
+	steps := findFailedSteps(analyzer.ParseSteps(logs), failedSteps)
+	if len(steps) == 0 {
+		return fmt.Errorf("no step matching BITRISE_FAILED_STEP_TITLE found in the logs")
+	}
+
+	failedStepFile := filepath.Join(outputDir, failedStepFileName)
+	if err := os.WriteFile(failedStepFile, []byte(reconstructLogsFromSteps(addFailedStepErrorToSteps(steps))), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", failedStepFile, err)
+	}
+	logInfof("Saved failed step logs to %s\n", failedStepFile)
+
+	return exportEnvVar("AI_ANALYZER_FAILED_STEP_LOG_PATH", absPath(failedStepFile))
+}
+
+// absPath returns the absolute path for exported outputs, or the path as is if it can't be resolved.
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+// exportEnvVar exposes a value to subsequent steps through envman. It is a no-op outside of
+// a Bitrise step environment, where envman isn't available.
+func exportEnvVar(key, value string) error {
+	envmanPath, err := exec.LookPath("envman")
+	if err != nil {
+		return nil
+	}
+
+	output, err := exec.Command(envmanPath, "add", "--key", key, "--value", value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("envman add failed: %v, output: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	logInfof("Exported %s\n", key)
+	return nil
+}
+
+// withJitter randomizes d by up to ±factor of it, factor is clamped to [0, 1].
+func withJitter(d time.Duration, factor float64) time.Duration {
+	if factor <= 0 {
+		return d
+	}
+	if factor > 1 {
+		factor = 1
+	}
+	return time.Duration(float64(d) * (1 + factor*(2*rand.Float64()-1)))
+}
+
+// sleepWithContext waits for the given duration, returning false if the context is cancelled first.
+func sleepWithContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// retryableError marks failures that may succeed when the request is repeated,
+// such as network errors, 5xx and 429 responses.
+type retryableError struct {
+	err error
+	// retryAfter is the wait requested by the server, zero if none was given
+	retryAfter time.Duration
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e retryableError) Unwrap() error {
+	return e.err
+}
+
+func isRetryable(err error) bool {
+	var retryErr retryableError
+	return errors.As(err, &retryErr)
+}
+
+// retryDelay prefers the server-provided Retry-After wait and falls back to exponential backoff.
+func retryDelay(err error, attempt int) time.Duration {
+	var retryErr retryableError
+	if errors.As(err, &retryErr) && retryErr.retryAfter > 0 {
+		return retryErr.retryAfter
+	}
+	return backoffDelay(attempt)
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP-date.
+func parseRetryAfter(header string) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
+
+// backoffDelay returns the wait before the given retry attempt (1s, 2s, 4s, ...), capped at maxBackoff.
+func backoffDelay(attempt int) time.Duration {
+	delay := time.Second
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// logCursor tracks where the next log request continues from. The timestamp cursor returned by the API
+// is preferred, the chunk position is used until the API returned one.
+type logCursor struct {
+	Position       int
+	AfterTimestamp string
+}
+
+func (c logCursor) String() string {
+	if c.AfterTimestamp != "" {
+		return fmt.Sprintf("timestamp: %s", c.AfterTimestamp)
+	}
+	return fmt.Sprintf("position: %d", c.Position)
+}
+
+// errRetryDeadline is returned by fetchLogChunk when the deadline leaves no time for another retry
+var errRetryDeadline = errors.New("no time left to retry")
+
+// fetchLogChunk requests the logs after the cursor, retrying failed requests. The retry waits, including
+// the Retry-After of rate limited requests, are cut to the deadline when set, e.g. the end of max_wait_seconds.
+func fetchLogChunk(ctx context.Context, client httpDoer, token, appSlug, buildSlug string, cursor logCursor, clk clock, deadline time.Time) (BitriseLogResponse, error) {
+	maxRetries := getEnvInt("max_retries", 3)
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			delay := retryDelay(lastErr, attempt)
+			if !deadline.IsZero() {
+				remaining := deadline.Sub(clk.Now())
+				if remaining <= 0 {
+					return BitriseLogResponse{}, fmt.Errorf("%w: %v", errRetryDeadline, lastErr)
+				}
+				if delay > remaining {
+					delay = remaining
+				}
+			}
+			logWarnf("⏳ Retrying log fetch in %s (attempt %d/%d): %v\n", delay, attempt, maxRetries, lastErr)
+			if !clk.Sleep(ctx, delay) {
+				return BitriseLogResponse{}, ctx.Err()
+			}
+		}
+
+		logResponse, err := requestLogChunk(ctx, client, token, appSlug, buildSlug, cursor)
+		if err == nil {
+			return logResponse, nil
+		}
+
+		// Other 4xx responses won't recover by retrying
+		if !isRetryable(err) {
+			return BitriseLogResponse{}, err
+		}
+		lastErr = err
+	}
+
+	return BitriseLogResponse{}, fmt.Errorf("giving up after %d retries: %v", maxRetries, lastErr)
+}
+
+func requestLogChunk(ctx context.Context, client httpDoer, token, appSlug, buildSlug string, cursor logCursor) (BitriseLogResponse, error) {
+	url := apiURL(fmt.Sprintf("/apps/%s/builds/%s/log", appSlug, buildSlug))
+
+	// Continue after the timestamp cursor, or from the position if not starting from the beginning
+	if cursor.AfterTimestamp != "" {
+		url = fmt.Sprintf("%s?after_timestamp=%s", url, neturl.QueryEscape(cursor.AfterTimestamp))
+	} else if cursor.Position > 0 {
+		url = fmt.Sprintf("%s?from=%d", url, cursor.Position)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return BitriseLogResponse{}, err
+	}
+
+	// Add authorization header
+	req.Header.Add("Authorization", "token "+token)
+
+	// Make the request
+	resp, err := client.Do(req)
+	if err != nil {
+		return BitriseLogResponse{}, retryableError{err: err}
+	}
+	defer resp.Body.Close()
+
+	// The whole body is read before decoding, within the timeout of the client, so a chunked response
+	// cut off mid-object fails as a read error instead of a partial decode, and errors can show the body
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return BitriseLogResponse{}, retryableError{err: fmt.Errorf("failed to read response body: %v", err)}
+	}
+
+	// Check response status
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("API request failed with status: %s, body: %s", resp.Status, truncateForError(bodyBytes))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return BitriseLogResponse{}, retryableError{err: err, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+		}
+		if resp.StatusCode >= 500 {
+			return BitriseLogResponse{}, retryableError{err: err}
+		}
+		return BitriseLogResponse{}, err
+	}
+
+	// Gateways occasionally answer with an HTML error page and a 200, retry those like a 5xx.
+	// Unmarshal also rejects concatenated JSON objects, which a decoder would silently stop after.
+	var logChunk BitriseLogResponse
+	if err := json.Unmarshal(bodyBytes, &logChunk); err != nil {
+		return BitriseLogResponse{}, retryableError{err: fmt.Errorf("invalid JSON in API response: %v, body: %s", err, truncateForError(bodyBytes))}
+	}
+
+	return logChunk, nil
+}
+
+// fetchCompleteLog fetches the whole log from the start, through the raw log URL when the log is archived
+// or else from the chunks of the first page. It also reports whether the log is archived.
+func fetchCompleteLog(ctx context.Context, client httpDoer, token, appSlug, buildSlug string) (string, bool, error) {
+	logResponse, err := fetchLogChunk(ctx, client, token, appSlug, buildSlug, logCursor{}, realClock{}, time.Time{})
+	if err != nil {
+		return "", false, err
+	}
+
+	if logResponse.ExpiringRawLogURL != "" {
+		var rawLog strings.Builder
+		err := downloadRawLog(ctx, client, logResponse.ExpiringRawLogURL, &rawLog)
+		if err == nil {
+			return rawLog.String(), logResponse.IsArchived, nil
+		}
+		logWarnf("⚠️  Failed to download raw log, falling back to log chunks: %v\n", err)
+	}
+
+	sort.Slice(logResponse.LogChunks, func(i, j int) bool {
+		return logResponse.LogChunks[i].Position < logResponse.LogChunks[j].Position
+	})
+	var logs strings.Builder
+	for _, chunk := range logResponse.LogChunks {
+		logs.WriteString(chunk.Chunk)
+	}
+	return logs.String(), logResponse.IsArchived && logResponse.NextAfterTimestamp == "", nil
+}
+
+// downloadRawLog streams the full log of an archived build to dst. The URL is presigned, so no auth header is sent.
+// The download is bounded by raw_log_download_timeout instead of the timeout of the API calls.
+func downloadRawLog(ctx context.Context, client httpDoer, url string, dst io.Writer) error {
+	timeoutSeconds := getEnvInt("raw_log_download_timeout", defaultRawLogDownloadTimeoutSeconds)
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultRawLogDownloadTimeoutSeconds
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	// The shared client would cut the download off after http_timeout_seconds, keep its connection pool only
+	if sharedClient, ok := client.(*http.Client); ok {
+		client = &http.Client{Transport: sharedClient.Transport}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("raw log download failed with status: %s", resp.Status)
+	}
+
+	if _, err := io.Copy(dst, resp.Body); err != nil {
+		return fmt.Errorf("raw log download failed: %v", err)
+	}
+	return nil
+}
+
+// streamRawLog downloads the raw log into logs and, when set, into a new output file replacing the
+// streamed chunks once the download completes. The body is copied as it arrives instead of buffered whole.
+// It also reports whether the last line of the log is left open, without a newline.
+func streamRawLog(ctx context.Context, client httpDoer, url, outputFile string, strip bool, logs io.Writer) (bool, error) {
+	var lastLine lastLineTracker
+	download := func(w io.Writer) error {
+		cleaning := &logCleaningWriter{w: io.MultiWriter(logs, w, &lastLine), strip: strip}
+		if err := downloadRawLog(ctx, client, url, cleaning); err != nil {
+			return err
+		}
+		return cleaning.flush()
+	}
+
+	var err error
+	if outputFile == "" {
+		err = download(io.Discard)
+	} else {
+		err = writeLogFileFrom(outputFile, download)
+	}
+	return lastLine.open, err
+}
+
+// lastLineTracker records whether the text written so far ends without a newline
+type lastLineTracker struct {
+	open bool
+}
+
+func (t *lastLineTracker) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		t.open = p[len(p)-1] != '\n'
+	}
+	return len(p), nil
+}
+
+// logCleaningWriter cleans the logs with cleanLogs line by line, so escape codes and secrets
+// split between writes are still removed
+type logCleaningWriter struct {
+	w       io.Writer
+	strip   bool
+	pending analyzer.LineBuffer
+}
+
+func (s *logCleaningWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(s.w, cleanLogs(s.pending.Push(string(p)), s.strip)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes the last line when it doesn't end with a newline
+func (s *logCleaningWriter) flush() error {
+	_, err := io.WriteString(s.w, cleanLogs(s.pending.Flush(), s.strip))
+	return err
+}
+
+// isGzipPath reports whether output written to the path is gzip compressed
+func isGzipPath(filePath string) bool {
+	return strings.HasSuffix(filePath, gzipSuffix)
+}
+
+// cleanLogs prepares collected logs for the output files and the AI, replacing invalid UTF-8 before anything
+// parses them, stripping the ANSI escape codes when strip is set and masking the secrets when redaction is enabled.
+// Logs are cleaned line by line, multi-byte characters are never split between calls.
+func cleanLogs(logs string, strip bool) string {
+	logs = analyzer.SanitizeUTF8(logs)
+	if strip {
+		logs = analyzer.StripANSI(logs)
+	}
+	return redactSecrets(logs)
+}
+
+// sourceDirPlaceholder replaces the workspace path in normalized logs
+const sourceDirPlaceholder = "$BITRISE_SOURCE_DIR"
+
+// defaultSourceDirs are the workspace paths of the Bitrise stacks, used when BITRISE_SOURCE_DIR is not set
+var defaultSourceDirs = []string{"/Users/vagrant/git", "/bitrise/src"}
+
+// normalizePaths rewrites the workspace path, e.g. /Users/vagrant/git/App/main.swift, to $BITRISE_SOURCE_DIR/App/main.swift.
+// Only whole path segments are replaced, so /Users/vagrant/git2 is left alone.
+func normalizePaths(logs string) string {
+	sourceDirs := defaultSourceDirs
+	if sourceDir := strings.TrimRight(strings.TrimSpace(getInput("BITRISE_SOURCE_DIR")), "/"); sourceDir != "" {
+		sourceDirs = []string{sourceDir}
+	}
 
-	fmt.Printf("Starting to fetch Bitrise build logs...")
-	fmt.Printf("App: %s, Build: %s\n\n", appSlug, buildSlug)
+	for _, sourceDir := range sourceDirs {
+		pattern := regexp.MustCompile(`(?m)` + regexp.QuoteMeta(sourceDir) + `([^\w.-]|$)`)
+		// "$" is doubled to keep the placeholder literal in the replacement template
+		logs = pattern.ReplaceAllString(logs, strings.ReplaceAll(sourceDirPlaceholder, "$", "$$")+"${1}")
+	}
+	return logs
+}
 
-	// Continue fetching logs until the build is finished
-	for {
-		fmt.Printf("🔄 Fetching logs from position: %d\n", position)
-		logResponse, err := fetchLogChunk(token, appSlug, buildSlug, position)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error fetching logs: %v\n", err)
-			os.Exit(1)
-		}
+// writeLogFile replaces the content of the output file, or prints it to stdout when no file is set,
+// between markers for stdoutOutputFile.
+func writeLogFile(filePath, content string) error {
+	if filePath == "" {
+		fmt.Print(content)
+		return nil
+	}
+	if filePath == stdoutOutputFile {
+		return writeStdoutBlock("LOGS", content)
+	}
 
-		fmt.Printf("📦 Received %d chunks, IsArchived: %t\n", len(logResponse.LogChunks), logResponse.IsArchived)
-		
-		// Process each log chunk
-		if len(logResponse.LogChunks) > 0 {
-			fmt.Printf("📝 Processing chunks with positions: ")
-			for _, chunk := range logResponse.LogChunks {
-				fmt.Printf("%d ", chunk.Position)
-			}
-			fmt.Printf("\n")
-			
-			// Show first chunk content preview
-			firstChunk := logResponse.LogChunks[0]
-			chunkPreview := strings.ReplaceAll(firstChunk.Chunk, "\n", "\\n")
-			if len(chunkPreview) > 100 {
-				chunkPreview = chunkPreview[:100] + "..."
-			}
-			fmt.Printf("🔍 First chunk (pos %d): %s\n", firstChunk.Position, chunkPreview)
-			
-			for _, chunk := range logResponse.LogChunks {
-				if chunk.Chunk != "" {
-					appendChunksToFile(outputFile, []string{chunk.Chunk})
-				}
+	return writeLogFileFrom(filePath, func(w io.Writer) error {
+		_, err := io.WriteString(w, content)
+		return err
+	})
+}
 
-				// Update the last position to the highest position we've seen
-				if chunk.Position > position {
-					position = chunk.Position
-				}
+// checkFileWritable reports whether the file can be created in its directory, without touching the file
+func checkFileWritable(filePath string) error {
+	file, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
 
-				if strings.Contains(chunk.Chunk, targetLogMessage) {
-					// Just found the target
-					foundTargetMessage = true
-					fmt.Println("\nFound target message. Collecting a few more lines...")
-				}
-			}
-		} else {
-			fmt.Printf("⚠️  No chunks received\n")
-		}
-		// If the log is archived, we can consider it finished
-		isFinished = logResponse.IsArchived
+// writeLogFileFrom replaces the file with what write writes, gzip compressed for .gz paths. It is written
+// to a temporary file renamed into place, so a step killed while writing never leaves a partial file behind.
+func writeLogFileFrom(filePath string, write func(w io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+	defer os.Remove(tempPath)
+	defer file.Close()
 
-		// If build is finished, exit the loop
-		if isFinished || foundTargetMessage {
-			fmt.Printf("\nLog collection finished.")
-			break
+	var writer io.Writer = file
+	var gzipWriter *gzip.Writer
+	if isGzipPath(filePath) {
+		gzipWriter = gzip.NewWriter(file)
+		writer = gzipWriter
+	}
+	if err := write(writer); err != nil {
+		return err
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			return err
 		}
-
-		// Wait before polling again
-		time.Sleep(time.Duration(interval) * time.Second)
 	}
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, filePath)
 }
 
-func fetchLogChunk(token, appSlug, buildSlug string, position int) (BitriseLogResponse, error) {
-	url := fmt.Sprintf("https://api.bitrise.io/v0.1/apps/%s/builds/%s/log", appSlug, buildSlug)
-
-	// Add position parameter if not starting from the beginning
-	if position > 0 {
-		url = fmt.Sprintf("%s?from=%d", url, position)
+// withCompletionMarker ends the logs with the completion marker, downstream steps can check for it
+// to tell complete logs from the partial logs of a step killed while collecting.
+func withCompletionMarker(logs string) string {
+	if logs != "" && !strings.HasSuffix(logs, "\n") {
+		logs += "\n"
 	}
+	return logs + completionMarker + "\n"
+}
 
-	req, err := http.NewRequest("GET", url, nil)
+// resolveBuildSlug looks up the slug of the app's build with the given build number.
+func resolveBuildSlug(ctx context.Context, client httpDoer, token, appSlug string, buildNumber int) (string, error) {
+	url := apiURL(fmt.Sprintf("/apps/%s/builds?build_num=%d", appSlug, buildNumber))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return BitriseLogResponse{}, err
+		return "", err
 	}
 
-	// Add authorization header
 	req.Header.Add("Authorization", "token "+token)
 
-	// Make the request
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return BitriseLogResponse{}, err
+		return "", err
 	}
 	defer resp.Body.Close()
 
-	// Check response status
-	if resp.StatusCode != http.StatusOK {
-		return BitriseLogResponse{}, fmt.Errorf("API request failed with status: %s", resp.Status)
-	}
-
-	// Parse the response
-	var logChunk BitriseLogResponse
-	err = json.NewDecoder(resp.Body).Decode(&logChunk)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return BitriseLogResponse{}, err
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("API request failed with status: %s, body: %s", resp.Status, truncateForError(body))
 	}
 
-	return logChunk, nil
-}
-
-func appendChunksToFile(filePath string, chunks []string) error {
-	// Open file for appending (create if doesn't exist)
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+	var builds BitriseBuildListResponse
+	if err := json.Unmarshal(body, &builds); err != nil {
+		return "", fmt.Errorf("failed to decode builds list: %v, body: %s", err, truncateForError(body))
 	}
-	defer file.Close()
 
-	// Write each chunk
-	for _, chunk := range chunks {
-		if _, err := file.WriteString(chunk); err != nil {
-			return err
+	var slugs []string
+	for _, build := range builds.Data {
+		if build.BuildNumber == buildNumber {
+			slugs = append(slugs, build.Slug)
 		}
 	}
-
-	return nil
+	switch len(slugs) {
+	case 0:
+		return "", fmt.Errorf("no build with number %d found for app %s", buildNumber, appSlug)
+	case 1:
+		return slugs[0], nil
+	default:
+		return "", fmt.Errorf("build number %d matches %d builds of app %s: %s", buildNumber, len(slugs), appSlug, strings.Join(slugs, ", "))
+	}
 }
 
-func fetchBitriseYAML(token, appSlug string) (string, error) {
-	url := fmt.Sprintf("https://api.bitrise.io/v0.1/apps/%s/bitrise.yml", appSlug)
+func fetchBitriseYAML(ctx context.Context, client httpDoer, token, appSlug string) (string, error) {
+	url := apiURL(fmt.Sprintf("/apps/%s/bitrise.yml", appSlug))
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return "", err
 	}
 
 	req.Header.Add("Authorization", "token "+token)
 
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
@@ -212,73 +1631,390 @@ func fetchBitriseYAML(token, appSlug string) (string, error) {
 	return string(bodyBytes), nil
 }
 
-func saveWorkflowContext(outputDir, token, appSlug string) error {
-	yamlContent, err := fetchBitriseYAML(token, appSlug)
+// saveWorkflowContext saves the app's bitrise.yml into outputDir and returns its content.
+// Without an outputDir the content is only returned.
+func saveWorkflowContext(ctx context.Context, client httpDoer, outputDir, token, appSlug string) (string, error) {
+	yamlContent, err := fetchBitriseYAML(ctx, client, token, appSlug)
 	if err != nil {
-		return fmt.Errorf("failed to fetch Bitrise YAML: %v", err)
+		return "", fmt.Errorf("failed to fetch Bitrise YAML: %v", err)
+	}
+	if outputDir == "" {
+		return yamlContent, nil
 	}
 
-	yamlFile := fmt.Sprintf("%s/bitrise.yml", outputDir)
+	yamlFile := filepath.Join(outputDir, "bitrise.yml")
 	err = os.WriteFile(yamlFile, []byte(yamlContent), 0644)
 	if err != nil {
-		return fmt.Errorf("failed to save YAML file: %v", err)
+		return "", fmt.Errorf("failed to save YAML file: %v", err)
 	}
 
-	fmt.Printf("Saved workflow context to %s\n", yamlFile)
-	return nil
+	logInfof("Saved workflow context to %s\n", yamlFile)
+	return yamlContent, nil
 }
 
 func optimizeLogsForAnalysis(logs string) string {
-	failedStepTitle := os.Getenv("BITRISE_FAILED_STEP_TITLE")
-	focusFailedStepOnly := os.Getenv("analyze_log_of_failed_step_only")
-	
+	// Without a reported failed step, e.g. when analyzing a historical build, use the one of the build summary
+	guessedFailedStep = ""
+	summaryFailedStep = ""
+	if strings.TrimSpace(getInput("BITRISE_FAILED_STEP_TITLE")) == "" {
+		if summaryFailedStep = failedStepFromBuildSteps(); summaryFailedStep != "" {
+			logInfof("No failed step reported, found in the build step metadata: %s\n", summaryFailedStep)
+		} else if summaryFailedStep = failedStepFromSummary(logs); summaryFailedStep != "" {
+			logInfof("No failed step reported, found in the build summary: %s\n", summaryFailedStep)
+		} else if getInput("guess_failed_step") != "false" {
+			guessedFailedStep = guessFailedStep(logs)
+			if guessedFailedStep != "" {
+				logInfof("No failed step reported, guessed from the logs: %s\n", guessedFailedStep)
+			}
+		}
+	}
+
+	// Runner specific paths make the same failure look different from build to build
+	if getInput("normalize_paths") == "true" {
+		logs = normalizePaths(logs)
+	}
+
+	failedSteps := failedStepsFromEnv()
+	focusFailedStepOnly := getInput("analyze_log_of_failed_step_only")
+
 	var optimized string
-	
-	// Step 1: Decide what logs to analyze (failed step vs full logs)
-	if failedStepTitle != "" && focusFailedStepOnly == "true" {
-		fmt.Printf("Focusing analysis on failed step: %s\n", failedStepTitle)
-		optimized = extractFailedStepLogs(logs, failedStepTitle)
+
+	// Step 1: Decide what logs to analyze (failed steps vs full logs)
+	if len(failedSteps) > 0 && focusFailedStepOnly == "true" {
+		for _, failed := range failedSteps {
+			logInfof("Focusing analysis on failed step: %s\n", failed.Title)
+		}
+		optimized = extractFailedStepLogs(logs, failedSteps)
 	} else {
 		// Use full logs
 		optimized = logs
 	}
-	
-	// Step 2: Apply step-specific filtering patterns (auto-detect from logs)
-	optimized = applyStepSpecificFiltering(optimized)
-	
+
+	// Step 2: Keep only what changed in the failed steps since the last successful build
+	if lastSuccessLogs != "" {
+		optimized = diffFailedStepsAgainst(optimized, lastSuccessLogs)
+	}
+
+	// Step 3: Keep only the most relevant steps of long workflows
+	if maxSteps := getEnvInt("max_steps", 0); maxSteps > 0 {
+		optimized = capSteps(optimized, maxSteps)
+	}
+
+	// Steps 4 to 6 run in analyzer.Optimize, configured here.
+	// Step 4: Apply step-specific filtering patterns (auto-detect from logs), unless the streaming parser already did.
+	// It filtered the steps before the failed step was detected above, so they are only annotated now.
+	var filter *stepFilter
+	if !stepsFilteredWhileCollecting {
+		filter = newStepFilter()
+	}
+	opts := analyzer.Options{
+		// Step 5: Collapse repeated stack traces, e.g. the same exception thrown by hundreds of flaky tests
+		CollapseRepeats: getInput("collapse_repeats") != "false",
+		FailedSteps:     failedStepTitles(failedStepsFromEnv()),
+	}
+	// Parallel steps interleave their output, put the lines annotated with their step back in time order
+	if chronologicalOrderEnabled() {
+		opts.Reorder = orderLinesChronologically
+	}
+	// Step 6: Fit the logs into the context window of the model consuming them,
+	// unless the analysis splits them into parts of that size instead
+	if chunkedAnalysisEnabled() {
+		logVerbosef("Chunked analysis is enabled, logs are not truncated to max_tokens\n")
+	} else {
+		opts.MaxTokens = getEnvInt("max_tokens", 0)
+	}
+
+	optimized = optimizeSteps(optimized, filter, opts)
+	if strings.HasPrefix(optimized, analyzer.TruncationNotePrefix) {
+		logWarnf("⚠️  Logs exceed the token budget of %d tokens, truncated\n", opts.MaxTokens)
+	}
 	return optimized
 }
 
-func addFailedStepErrorContext(logs, errorMessage string) string {
-	// Add the error message at the beginning as important context
-	contextHeader := fmt.Sprintf("=== FAILED STEP ERROR MESSAGE ===\n%s\n=== END ERROR MESSAGE ===\n\n", errorMessage)
-	return contextHeader + logs
+// failedStep is a step reported as failed by Bitrise, with its error message if any
+type failedStep struct {
+	Title        string
+	ErrorMessage string
 }
 
-func extractFailedStepLogs(logs, stepTitle string) string {
-	steps := parseLogsIntoSteps(logs)
-	
-	// Find the failed step by title
-	for _, step := range steps {
-		if strings.Contains(strings.ToLower(step.Title), strings.ToLower(stepTitle)) {
-			return step.Logs
+// guessedFailedStep is the title of the step guessed to have failed from the logs,
+// set by optimizeLogsForAnalysis when BITRISE_FAILED_STEP_TITLE is empty
+var guessedFailedStep string
+
+// summaryFailedStep is the title of the first failed step of the build step metadata or the build summary table,
+// set by optimizeLogsForAnalysis when BITRISE_FAILED_STEP_TITLE is empty
+var summaryFailedStep string
+
+// detectedFailedStep returns the failed step found in the logs when Bitrise doesn't report one,
+// and whether it was only guessed. The build summary is preferred over guessing.
+func detectedFailedStep() (string, bool) {
+	if summaryFailedStep != "" {
+		return summaryFailedStep, false
+	}
+	return guessedFailedStep, guessedFailedStep != ""
+}
+
+var (
+	// buildSummaryRowPattern matches a step of the summary table like "| x | Xcode Test for iOS (exit code: 65) | 45 sec |"
+	buildSummaryRowPattern      = regexp.MustCompile(`^\|\s*([^|]*?)\s*\|\s*(.+?)\s*\|\s*[^|]*\|$`)
+	buildSummaryExitCodePattern = regexp.MustCompile(`\s*\(exit code:\s*\d+\).*$`)
+)
+
+// failedStepFromSummary returns the title of the first step marked as failed (x, ✗ or "fail")
+// in the build summary table, or "" when the logs have no summary or no failed step.
+func failedStepFromSummary(logs string) string {
+	inSummary := false
+	for _, line := range strings.Split(logs, "\n") {
+		line = strings.TrimSpace(analyzer.StripANSI(line))
+		if analyzer.IsBuildSummaryHeaderLine(line) {
+			inSummary = true
+			continue
+		}
+		if !inSummary {
+			continue
+		}
+
+		match := buildSummaryRowPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		status := strings.ToLower(match[1])
+		if status == "x" || status == "✗" || status == "✕" || strings.Contains(status, "fail") {
+			return buildSummaryExitCodePattern.ReplaceAllString(match[2], "")
 		}
 	}
-	
-	// Fallback: return original logs if step not found
-	return logs
+	return ""
+}
+
+// failureIndicatorPattern matches log lines hinting at a failure, for guessing the failed step
+var failureIndicatorPattern = regexp.MustCompile(`(?i)\berror\b|\bfailed\b|\bfailure\b`)
+
+// failedStepsFromEnv reads the failed steps from BITRISE_FAILED_STEP_TITLE and BITRISE_FAILED_STEP_ERROR_MESSAGE.
+// Several failed steps (e.g. with continue-on-error) are given as comma-separated lists,
+// where the n-th error message belongs to the n-th title and the last one keeps any remaining commas.
+// Titles containing commas are given one per line instead; their error messages are paired line by line
+// when there is one line per title, otherwise the whole message belongs to the first title.
+// Without a reported failed step, the one found in the logs is returned if any.
+func failedStepsFromEnv() []failedStep {
+	titlesValue := strings.TrimSpace(getInput("BITRISE_FAILED_STEP_TITLE"))
+	if titlesValue == "" {
+		if detected, _ := detectedFailedStep(); detected != "" {
+			return []failedStep{{Title: detected}}
+		}
+		return nil
+	}
+
+	separator := ","
+	if strings.Contains(titlesValue, "\n") {
+		separator = "\n"
+	}
+	var titles []string
+	for _, title := range strings.Split(titlesValue, separator) {
+		if title = strings.TrimSpace(title); title != "" {
+			titles = append(titles, title)
+		}
+	}
+	errorMessage := strings.TrimSpace(getInput("BITRISE_FAILED_STEP_ERROR_MESSAGE"))
+	errorMessages := strings.SplitN(errorMessage, ",", len(titles))
+	if separator == "\n" {
+		errorMessages = []string{errorMessage}
+		if lines := strings.Split(errorMessage, "\n"); len(titles) > 1 && len(lines) == len(titles) {
+			errorMessages = lines
+		}
+	}
+
+	failedSteps := make([]failedStep, 0, len(titles))
+	for i, title := range titles {
+		failed := failedStep{Title: title}
+		if i < len(errorMessages) {
+			failed.ErrorMessage = strings.TrimSpace(errorMessages[i])
+		}
+		failedSteps = append(failedSteps, failed)
+	}
+	return failedSteps
+}
+
+// guessFailedStep picks the step most likely to have failed, for when Bitrise didn't report one
+// (e.g. infra failures). A non-zero exit code outweighs any number of error lines,
+// ties go to the later step since a failure usually ends the build. Returns "" when nothing looks failed.
+func guessFailedStep(logs string) string {
+	const exitCodeWeight = 1000
+
+	bestTitle := ""
+	bestScore := 0
+	for _, step := range analyzer.ParseSteps(logs) {
+		if step.Title == analyzer.UnknownStepTitle {
+			continue
+		}
+
+		score := len(failureIndicatorPattern.FindAllStringIndex(step.Logs, -1))
+		if step.ExitCode != 0 {
+			score += exitCodeWeight
+		}
+		if score > 0 && score >= bestScore {
+			bestTitle, bestScore = step.Title, score
+		}
+	}
+	return bestTitle
+}
+
+func addFailedStepErrorContext(logs, stepTitle, errorMessage string) string {
+	// Add the failed step title and error message at the beginning as important context,
+	// this also delimits the logs of each failed step
+	contextHeader := fmt.Sprintf("=== FAILED STEP: %s ===\n", stepTitle)
+	if errorMessage != "" {
+		contextHeader += fmt.Sprintf("=== FAILED STEP ERROR MESSAGE ===\n%s\n=== END ERROR MESSAGE ===\n", errorMessage)
+	}
+
+	// Insert the header right after the step's title line, so the annotated logs still parse into the same steps
+	lines := strings.SplitAfter(logs, "\n")
+	for i, line := range lines {
+		if analyzer.IsStepTitleLine(strings.TrimSuffix(line, "\n")) && strings.HasSuffix(line, "\n") {
+			return strings.Join(lines[:i+1], "") + contextHeader + "\n" + strings.Join(lines[i+1:], "")
+		}
+	}
+	return contextHeader + "\n" + logs
 }
 
+// failedStepTitles returns the titles of the failed steps, for the analyzer package
+func failedStepTitles(failedSteps []failedStep) []string {
+	titles := make([]string, 0, len(failedSteps))
+	for _, failed := range failedSteps {
+		titles = append(titles, failed.Title)
+	}
+	return titles
+}
 
-func containsString(slice []string, item string) bool {
-	for _, s := range slice {
-		if s == item {
+func isReportedFailedStep(stepTitle string, failedSteps []failedStep) bool {
+	for _, failed := range failedSteps {
+		if analyzer.MatchesStepTitle(stepTitle, failed.Title) {
 			return true
 		}
 	}
 	return false
 }
 
+// findFailedSteps returns the steps matching the reported failed steps, in build order.
+func findFailedSteps(steps []analyzer.StepLogs, failedSteps []failedStep) []analyzer.StepLogs {
+	var found []analyzer.StepLogs
+	for _, step := range steps {
+		if isReportedFailedStep(step.Title, failedSteps) {
+			found = append(found, step)
+		}
+	}
+	return found
+}
+
+// warnUnmatchedFailedSteps names the reported failed steps missing from the logs, with the parsed titles to compare against.
+func warnUnmatchedFailedSteps(steps []analyzer.StepLogs, failedSteps []failedStep) {
+	var parsedTitles []string
+	for _, step := range steps {
+		parsedTitles = append(parsedTitles, fmt.Sprintf("%q", step.Title))
+	}
+
+	for _, failed := range failedSteps {
+		if len(findFailedSteps(steps, []failedStep{failed})) > 0 {
+			continue
+		}
+		logWarnf("⚠️  Warning: failed step %q was not found in the logs, parsed steps: %s\n", failed.Title, strings.Join(parsedTitles, ", "))
+	}
+}
+
+func extractFailedStepLogs(logs string, failedSteps []failedStep) string {
+	// Failed steps are annotated later, when the extracted logs are filtered
+	steps := analyzer.ParseSteps(logs)
+	warnUnmatchedFailedSteps(steps, failedSteps)
+
+	// The steps right before a failed step (e.g. installing dependencies) often hold the real cause
+	stepsBefore := maxInt(getEnvInt("include_steps_before", 0), 0)
+	included := make([]bool, len(steps))
+	for i, step := range steps {
+		if !isReportedFailedStep(step.Title, failedSteps) {
+			continue
+		}
+		for j := maxInt(i-stepsBefore, 0); j <= i; j++ {
+			included[j] = true
+		}
+	}
+
+	var extracted []analyzer.StepLogs
+	for i, step := range steps {
+		if included[i] {
+			extracted = append(extracted, step)
+		}
+	}
+	if len(extracted) > 0 {
+		return reconstructLogsFromSteps(extracted)
+	}
+
+	// Fallback: return original logs if no failed step was found
+	return logs
+}
+
+// maskToken hides all but the last 4 characters of a secret so it can be logged safely.
+func maskToken(token string) string {
+	if token == "" {
+		return "(not set)"
+	}
+	if len(token) <= 8 {
+		return "****"
+	}
+	return "****" + token[len(token)-4:]
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value := strings.TrimSpace(getInput(key))
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		logWarnf("Warning: invalid value for %s (%q), using default %d\n", key, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// parsePollInterval parses the interval input, seconds like "10" or a duration like "1500ms".
+// Empty and invalid values use defaultPollInterval, intervals below minPollInterval are raised to it.
+func parsePollInterval(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return defaultPollInterval
+	}
+
+	var interval time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		interval = time.Duration(seconds) * time.Second
+	} else if duration, err := time.ParseDuration(value); err == nil {
+		interval = duration
+	} else {
+		logWarnf("⚠️  Warning: invalid interval %q, using %s\n", value, defaultPollInterval)
+		return defaultPollInterval
+	}
+
+	if interval < minPollInterval {
+		logWarnf("⚠️  Warning: interval must be at least %s, got %s. Using %s.\n", minPollInterval, interval, minPollInterval)
+		return minPollInterval
+	}
+	return interval
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := strings.TrimSpace(getInput(key))
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		logWarnf("Warning: invalid value for %s (%q), using default %g\n", key, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
 func maxInt(a, b int) int {
 	if a > b {
 		return a
@@ -293,201 +2029,221 @@ func minInt(a, b int) int {
 	return b
 }
 
-func applyStepSpecificFiltering(logs string) string {
+// optimizeSteps annotates the failed steps, reduces each step with the filter and then the whole logs as
+// configured by opts, see analyzer.Optimize. A nil filter keeps the steps, e.g. when filtered while collecting.
+func optimizeSteps(logs string, filter *stepFilter, opts analyzer.Options) string {
 	// Always parse logs into steps first (and add error message to failed step)
 	steps := parseLogsIntoSteps(logs)
-	
-	patternsEnabled := os.Getenv("step_log_filter_patterns_enabled")
-	if patternsEnabled != "true" {
-		// Patterns disabled, just reconstruct and return logs without filtering
-		return reconstructLogsFromSteps(steps)
-	}
-	
-	patterns := os.Getenv("step_log_filter_patterns")
-	if patterns == "" {
-		// Configuration issue - filtering enabled but no patterns defined
-		fmt.Println("Warning: step_log_filter_patterns_enabled is true but step_log_filter_patterns is empty. Returning logs without filtering.")
-		return reconstructLogsFromSteps(steps)
-	}
-	
-	var filteredResults []string
-	for _, step := range steps {
-		stepType := detectStepTypeFromTitle(step.Title, patterns)
-		
-		if stepType != "" {
-			fmt.Printf("Step '%s' detected as type '%s', applying filtering\n", step.Title, stepType)
-			filtered := filterStepLogsByPatterns(step.Logs, stepType, patterns)
-			filteredResults = append(filteredResults, filtered)
-		} else {
-			fmt.Printf("Step '%s' has no specific patterns, including all logs\n", step.Title)
-			filteredResults = append(filteredResults, step.Logs)
+	// cleanLogs already stripped the escape codes unless strip_ansi is disabled
+	opts.KeepANSI = true
+	if filter != nil {
+		warnUnmatchedBuildSteps(steps)
+		if !filter.isNoop() {
+			opts.StepFilter = filter.apply
 		}
 	}
-	
-	return strings.Join(filteredResults, "\n\n")
+
+	optimized := analyzer.Optimize(reconstructLogsFromSteps(steps), opts)
+	if opts.StepFilter != nil && currentLogLevel >= logLevelVerbose {
+		printStepSizes(filter.sizes)
+	}
+	return optimized
 }
 
-type StepLogs struct {
-	Title string
-	Logs  string
+// stepFilter reduces the logs of a single step as configured by the filtering inputs,
+// so steps can be filtered one by one as they are parsed.
+type stepFilter struct {
+	patterns      string
+	filterOptions analyzer.FilterOptions
+	// The error is almost always near the end of a step, 0 keeps all lines
+	tailLines     int
+	extractErrors bool
+	includeTitles []string
+	excludeTitles []string
+	// chronological annotates each line with the step title, for ordering the lines of all steps by time
+	chronological bool
+	// sizes records the lines of each step before and after filtering
+	sizes []stepSize
 }
 
-func parseLogsIntoSteps(logs string) []StepLogs {
-	lines := strings.Split(logs, "\n")
-	var steps []StepLogs
-	var currentStep *StepLogs
-	
-	for _, line := range lines {
-		// Look for step boundary markers like "| (0) Git Clone Repository |"
-		if strings.Contains(line, "+----") && strings.Contains(line, "|") {
-			// Check if this is a step title line (contains step number)
-			if strings.Contains(line, ") ") {
-				// Save previous step if exists
-				if currentStep != nil {
-					steps = append(steps, *currentStep)
-				}
-				
-				// Extract step title
-				stepTitle := extractStepTitle(line)
-				currentStep = &StepLogs{
-					Title: stepTitle,
-					Logs:  line + "\n",
-				}
-			} else if currentStep != nil {
-				// This is a step boundary but not the title, add to current step
-				currentStep.Logs += line + "\n"
-			}
-		} else if currentStep != nil {
-			// Regular log line, add to current step
-			currentStep.Logs += line + "\n"
-		}
+func newStepFilter() *stepFilter {
+	patterns := ""
+	if getInput("step_log_filter_patterns_enabled") == "true" {
+		patterns = enabledFilterPatterns(getInput("step_log_filter_patterns"))
 	}
-	
-	// Add the last step
-	if currentStep != nil {
-		steps = append(steps, *currentStep)
+	return newStepFilterWithPatterns(patterns)
+}
+
+// enabledFilterPatterns returns the patterns of enabled filtering: the given ones, or the built-in ones when empty
+func enabledFilterPatterns(patterns string) string {
+	if strings.TrimSpace(patterns) == "" {
+		// Filtering enabled without patterns, work out of the box with the built-in ones
+		logInfof("step_log_filter_patterns is empty, using the built-in patterns\n")
+		return analyzer.DefaultFilterPatterns
 	}
-	
-	// Add failed step error message to the appropriate step
-	steps = addFailedStepErrorToSteps(steps)
-	
-	return steps
+	return patterns
 }
 
-func addFailedStepErrorToSteps(steps []StepLogs) []StepLogs {
-	failedStepTitle := os.Getenv("BITRISE_FAILED_STEP_TITLE")
-	failedStepError := os.Getenv("BITRISE_FAILED_STEP_ERROR_MESSAGE")
-	
-	if failedStepTitle == "" || failedStepError == "" {
-		return steps
+// newStepFilterWithPatterns reads the filtering inputs other than the patterns, empty patterns keep every line
+func newStepFilterWithPatterns(patterns string) *stepFilter {
+	return &stepFilter{
+		patterns:      patterns,
+		filterOptions: filterOptions(),
+		tailLines:     getEnvInt("tail_lines_per_step", 0),
+		extractErrors: getInput("extract_errors") != "false",
+		includeTitles: stepTitleList(getInput("include_step_titles")),
+		excludeTitles: stepTitleList(getInput("exclude_step_titles")),
+		chronological: chronologicalOrderEnabled(),
 	}
-	
-	// Find the failed step and add error message
-	for i, step := range steps {
-		if strings.Contains(strings.ToLower(step.Title), strings.ToLower(failedStepTitle)) {
-			fmt.Printf("Adding error message to failed step: %s\n", step.Title)
-			steps[i].Logs = addFailedStepErrorContext(step.Logs, failedStepError)
-			break
+}
+
+// isNoop reports whether the filter keeps every step unchanged
+func (f *stepFilter) isNoop() bool {
+	return f.patterns == "" && f.tailLines <= 0 && !f.extractErrors && len(f.includeTitles) == 0 && len(f.excludeTitles) == 0 && !f.chronological
+}
+
+// apply returns the filtered logs of the step, or false when the step is dropped altogether.
+func (f *stepFilter) apply(step analyzer.StepLogs) (string, bool) {
+	if !isStepTitleWanted(step.Title, f.includeTitles, f.excludeTitles) {
+		logVerbosef("Step '%s' is not wanted by include_step_titles/exclude_step_titles, dropping it\n", step.Title)
+		f.sizes = append(f.sizes, stepSize{title: step.Title, inputLines: countLines(step.Logs)})
+		return "", false
+	}
+
+	stepLogs := step.Logs
+	// Extract before filtering, which may drop parts of the error block
+	extracted := ""
+	if f.extractErrors {
+		extracted = extractStepErrors(step, f.patterns)
+	}
+	if f.patterns != "" {
+		stepType := stepTypeOf(step.Title, f.patterns)
+		if stepType != "" {
+			logVerbosef("Step '%s' detected as type '%s', applying filtering\n", step.Title, stepType)
+			stepLogs = analyzer.WithStepResult(analyzer.FilterStepLogs(step.Logs, stepType, f.patterns, f.filterOptions), step)
+		} else {
+			logVerbosef("Step '%s' has no specific patterns, including all logs\n", step.Title)
 		}
 	}
-	
-	return steps
+	stepLogs = prependExtractedErrors(analyzer.TailStepLines(stepLogs, f.tailLines), extracted)
+
+	f.sizes = append(f.sizes, stepSize{title: step.Title, inputLines: countLines(step.Logs), outputLines: countLines(stepLogs)})
+	if f.chronological {
+		stepLogs = annotateStepLines(stepLogs, step.Title)
+	}
+	return stepLogs, true
 }
 
-func reconstructLogsFromSteps(steps []StepLogs) string {
-	var result []string
-	for _, step := range steps {
-		result = append(result, step.Logs)
+// stepSize is the number of lines of a step before and after filtering
+type stepSize struct {
+	title       string
+	inputLines  int
+	outputLines int
+}
+
+// printStepSizes prints how many lines each step kept, largest output first,
+// so a step whose patterns are too loose stands out.
+func printStepSizes(sizes []stepSize) {
+	sort.SliceStable(sizes, func(i, j int) bool {
+		return sizes[i].outputLines > sizes[j].outputLines
+	})
+
+	logVerbosef("\n📏 Lines per step after filtering\n")
+	for _, size := range sizes {
+		logVerbosef("  %s: %d -> %d lines\n", size.title, size.inputLines, size.outputLines)
 	}
-	return strings.Join(result, "\n")
 }
 
-func extractStepTitle(line string) string {
-	// Extract step title from line like "| (0) Git Clone Repository                |"
-	parts := strings.Split(line, "|")
-	if len(parts) >= 2 {
-		titlePart := strings.TrimSpace(parts[1])
-		// Remove the step number part like "(0) "
-		if idx := strings.Index(titlePart, ") "); idx != -1 && idx < 10 {
-			return strings.TrimSpace(titlePart[idx+2:])
+// stepTitleList parses a comma-separated list of step titles, lowercased for case-insensitive matching.
+func stepTitleList(value string) []string {
+	var titles []string
+	for _, title := range strings.Split(value, ",") {
+		if title = strings.ToLower(strings.TrimSpace(title)); title != "" {
+			titles = append(titles, title)
 		}
-		return titlePart
 	}
-	return ""
+	return titles
 }
 
-func detectStepTypeFromTitle(stepTitle, patterns string) string {
-	if stepTitle == "" {
-		return ""
-	}
-	
-	stepLower := strings.ToLower(stepTitle)
-	lines := strings.Split(patterns, "\n")
-	
-	for _, line := range lines {
-		if strings.Contains(line, ":") {
-			parts := strings.SplitN(line, ":", 2)
-			stepType := strings.TrimSpace(parts[0])
-			
-			// Check if step title contains this type
-			if strings.Contains(stepLower, stepType) {
-				return stepType
-			}
+// isStepTitleWanted reports whether a step is kept: its title contains one of the included titles,
+// when any, and none of the excluded ones. Exclusion wins over inclusion.
+func isStepTitleWanted(stepTitle string, includeTitles, excludeTitles []string) bool {
+	titleLower := strings.ToLower(stepTitle)
+	for _, excluded := range excludeTitles {
+		if strings.Contains(titleLower, excluded) {
+			return false
 		}
 	}
-	
-	return ""
+	if len(includeTitles) == 0 {
+		return true
+	}
+	for _, included := range includeTitles {
+		if strings.Contains(titleLower, included) {
+			return true
+		}
+	}
+	return false
 }
 
-func filterStepLogsByPatterns(stepLogs, stepType, allPatterns string) string {
-	// Extract keywords for this step type
-	lines := strings.Split(allPatterns, "\n")
-	var keywords []string
-	
-	for _, line := range lines {
-		if strings.HasPrefix(strings.TrimSpace(line), stepType+":") {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) == 2 {
-				keywordStr := strings.TrimSpace(parts[1])
-				keywords = strings.Split(keywordStr, ",")
-				// Trim whitespace from each keyword
-				for i, keyword := range keywords {
-					keywords[i] = strings.TrimSpace(keyword)
-				}
-				break
-			}
+func parseLogsIntoSteps(logs string) []analyzer.StepLogs {
+	steps := analyzer.ParseSteps(logs)
+
+	// Add failed step error messages to the appropriate steps
+	return addFailedStepErrorToSteps(steps)
+}
+
+func addFailedStepErrorToSteps(steps []analyzer.StepLogs) []analyzer.StepLogs {
+	failedSteps := failedStepsFromEnv()
+
+	// A single failed step is only annotated when there is an error message,
+	// several failed steps are always delimited so each failure can be told apart
+	for _, failed := range failedSteps {
+		if failed.ErrorMessage == "" && len(failedSteps) == 1 {
+			continue
 		}
-	}
-	
-	if len(keywords) == 0 {
-		return stepLogs
-	}
-	
-	// Apply filtering with these keywords
-	logLines := strings.Split(stepLogs, "\n")
-	var filtered []string
-	
-	for i, line := range logLines {
-		for _, keyword := range keywords {
-			if keyword != "" && strings.Contains(line, keyword) {
-				// Include context around matching lines
-				start := maxInt(0, i-2)
-				end := minInt(len(logLines), i+4)
-				
-				for j := start; j < end; j++ {
-					if !containsString(filtered, logLines[j]) {
-						filtered = append(filtered, logLines[j])
-					}
-				}
+
+		// Find the failed step and add error message
+		for i, step := range steps {
+			if analyzer.MatchesStepTitle(step.Title, failed.Title) {
+				logVerbosef("Adding error message to failed step: %s\n", step.Title)
+				steps[i].Logs = addFailedStepErrorContext(step.Logs, step.Title, failed.ErrorMessage)
 				break
 			}
 		}
 	}
-	
-	if len(filtered) > 0 {
-		return strings.Join(filtered, "\n")
+
+	return steps
+}
+
+func reconstructLogsFromSteps(steps []analyzer.StepLogs) string {
+	var result []string
+	for _, step := range steps {
+		result = append(result, step.Logs)
+	}
+	return analyzer.JoinStepLogs(result)
+}
+
+// filterOptions reads the inputs configuring how the step logs are filtered by the patterns
+func filterOptions() analyzer.FilterOptions {
+	return analyzer.FilterOptions{
+		MatchMode:          keywordMatchMode(),
+		ContextLinesBefore: getEnvInt("context_lines_before", analyzer.DefaultContextLinesBefore),
+		ContextLinesAfter:  getEnvInt("context_lines_after", analyzer.DefaultContextLinesAfter),
+		DedupeLines:        getInput("dedupe_filtered_lines") == "true",
+		Warnf:              logWarnf,
+	}
+}
+
+// keywordMatchMode returns how step types and filter keywords are matched, substring by default.
+func keywordMatchMode() string {
+	mode := strings.ToLower(strings.TrimSpace(getInput("match_mode")))
+	switch mode {
+	case "":
+		return analyzer.MatchModeSubstring
+	case analyzer.MatchModeSubstring, analyzer.MatchModeWord, analyzer.MatchModeExact:
+		return mode
+	default:
+		logWarnf("Warning: unknown match_mode %q, using %s\n", mode, analyzer.MatchModeSubstring)
+		return analyzer.MatchModeSubstring
 	}
-	
-	// If no keywords matched, return original step logs
-	return stepLogs
 }
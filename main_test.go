@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectBuildLogsPollsUntilArchivedAndDrained(t *testing.T) {
+	api := newFakeBitriseAPI(t,
+		logPage(false, 0, "Compiling\n"),
+		// A quiet build returns no new chunks for a while
+		logPage(false, 1),
+		logPage(false, 1, "Linking\n"),
+		logPage(true, 2),
+		// The final chunk can arrive on the poll after the log was archived
+		logPage(true, 2, "error: linker command failed\n"),
+	)
+
+	logs, err := collectBuildLogs(context.Background(), testCollectorOptions(newFakeClock(time.Unix(0, 0))))
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "Compiling\nLinking\nerror: linker command failed\n"; logs != want {
+		t.Errorf("logs = %q, want %q", logs, want)
+	}
+	if requests := api.Requests(); len(requests) != 5 {
+		t.Errorf("got %d polls, want 5: %v", len(requests), requests)
+	}
+	if logCompleteness != logCompletenessFinishedArchived {
+		t.Errorf("log completeness = %q, want %q", logCompleteness, logCompletenessFinishedArchived)
+	}
+}
+
+func TestCollectBuildLogsSkipsOverlappingChunks(t *testing.T) {
+	newFakeBitriseAPI(t,
+		logPage(false, 0, "Compiling\n", "Linking\n"),
+		// The next poll returns the last chunk of the previous one again
+		logPage(true, 1, "Linking\n", "error: linker command failed\n"),
+	)
+
+	logs, err := collectBuildLogs(context.Background(), testCollectorOptions(newFakeClock(time.Unix(0, 0))))
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "Compiling\nLinking\nerror: linker command failed\n"; logs != want {
+		t.Errorf("logs = %q, want %q", logs, want)
+	}
+}
+
+func TestCollectBuildLogsPagesThroughTimestamps(t *testing.T) {
+	pages := []fakeLogPage{
+		logPage(true, 0, "Compiling\n"),
+		logPage(true, 1, "Linking\n"),
+		logPage(true, 2, "error: linker command failed\n"),
+	}
+	pages[0].response.NextAfterTimestamp = "2024-05-01T10:00:01Z"
+	pages[1].response.NextAfterTimestamp = "2024-05-01T10:00:02Z"
+	api := newFakeBitriseAPI(t, pages...)
+	clk := newFakeClock(time.Unix(0, 0))
+
+	logs, err := collectBuildLogs(context.Background(), testCollectorOptions(clk))
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "Compiling\nLinking\nerror: linker command failed\n"; logs != want {
+		t.Errorf("logs = %q, want %q", logs, want)
+	}
+	requests := api.Requests()
+	if len(requests) < 3 || !strings.Contains(requests[1], "after_timestamp=2024-05-01T10%3A00%3A01Z") || !strings.Contains(requests[2], "after_timestamp=2024-05-01T10%3A00%3A02Z") {
+		t.Errorf("requests = %v, want the pages after each timestamp cursor", requests)
+	}
+	// The pages of an archived log are fetched right away
+	if sleeps := clk.Sleeps(); len(sleeps) != 0 {
+		t.Errorf("slept %v between pages", sleeps)
+	}
+}
+
+func TestCollectBuildLogsResumesPartialLineAfterFailure(t *testing.T) {
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint.json")
+	newFakeBitriseAPI(t,
+		logPage(false, 0, "Compiling\nLink"),
+		fakeLogPage{status: http.StatusUnauthorized, body: "unauthorized"},
+	)
+	opts := testCollectorOptions(newFakeClock(time.Unix(0, 0)))
+	opts.checkpointFile = checkpointFile
+
+	if _, err := collectBuildLogs(context.Background(), opts); exitCodeOf(err) != exitAPIError {
+		t.Fatalf("error = %v, want an API error", err)
+	}
+
+	// The retried step gets the whole log again, the chunks before the checkpoint are skipped
+	newFakeBitriseAPI(t, logPage(true, 0, "Compiling\nLink", "ing done\n"))
+	opts = testCollectorOptions(newFakeClock(time.Unix(0, 0)))
+	opts.checkpointFile = checkpointFile
+
+	logs, err := collectBuildLogs(context.Background(), opts)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "Compiling\nLinking done\n"; logs != want {
+		t.Errorf("logs = %q, want %q", logs, want)
+	}
+}
+
+func TestCollectBuildLogsResumeDropsLogsAfterCheckpoint(t *testing.T) {
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint.json")
+	newFakeBitriseAPI(t,
+		logPage(false, 0, "Compiling\n"),
+		fakeLogPage{status: http.StatusUnauthorized, body: "unauthorized"},
+	)
+	opts := testCollectorOptions(newFakeClock(time.Unix(0, 0)))
+	opts.checkpointFile = checkpointFile
+
+	if _, err := collectBuildLogs(context.Background(), opts); exitCodeOf(err) != exitAPIError {
+		t.Fatalf("error = %v, want an API error", err)
+	}
+	// A step killed after a poll appended its logs, but before it saved the checkpoint position
+	if err := appendCheckpointLogs(checkpointFile, "Linking\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	newFakeBitriseAPI(t, logPage(true, 0, "Compiling\n", "Linking\n"))
+	opts = testCollectorOptions(newFakeClock(time.Unix(0, 0)))
+	opts.checkpointFile = checkpointFile
+
+	logs, err := collectBuildLogs(context.Background(), opts)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "Compiling\nLinking\n"; logs != want {
+		t.Errorf("logs = %q, want %q", logs, want)
+	}
+}
+
+func TestFailedStepsFromEnv(t *testing.T) {
+	tests := []struct {
+		name          string
+		titles        string
+		errorMessages string
+		want          []failedStep
+	}{
+		{
+			name:          "single title",
+			titles:        "Xcode Test for iOS",
+			errorMessages: "exit status 65",
+			want:          []failedStep{{Title: "Xcode Test for iOS", ErrorMessage: "exit status 65"}},
+		},
+		{
+			name:          "comma-separated titles",
+			titles:        "Xcode Test for iOS, Deploy",
+			errorMessages: "exit status 65, upload failed, retrying",
+			want: []failedStep{
+				{Title: "Xcode Test for iOS", ErrorMessage: "exit status 65"},
+				{Title: "Deploy", ErrorMessage: "upload failed, retrying"},
+			},
+		},
+		{
+			name:          "titles containing commas one per line",
+			titles:        "Build, test and archive\nDeploy\n",
+			errorMessages: "exit status 65\nupload failed",
+			want: []failedStep{
+				{Title: "Build, test and archive", ErrorMessage: "exit status 65"},
+				{Title: "Deploy", ErrorMessage: "upload failed"},
+			},
+		},
+		{
+			name:          "a multi-line message of titles one per line belongs to the first title",
+			titles:        "Build, test and archive\nDeploy",
+			errorMessages: "error: no such module\nerror: build failed\nexit status 65",
+			want: []failedStep{
+				{Title: "Build, test and archive", ErrorMessage: "error: no such module\nerror: build failed\nexit status 65"},
+				{Title: "Deploy"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("BITRISE_FAILED_STEP_TITLE", tt.titles)
+			t.Setenv("BITRISE_FAILED_STEP_ERROR_MESSAGE", tt.errorMessages)
+
+			if got := failedStepsFromEnv(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("failed steps = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
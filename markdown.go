@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
+)
+
+// outputFormatMarkdown formats the analysis file for PR comments, the output file stays plain text
+const outputFormatMarkdown = "markdown"
+
+// markdownExcerptLines is how many lines of the failed step the collapsed log excerpt shows
+const markdownExcerptLines = 40
+
+// markdownSectionsPattern matches the headings the prompt asks for in markdown mode
+var markdownSectionsPattern = regexp.MustCompile(`(?im)^#{1,6}\s*likely cause\b[\s\S]*^#{1,6}\s*suggested fix\b`)
+
+func markdownOutputEnabled() bool {
+	return strings.EqualFold(strings.TrimSpace(getInput("output_format")), outputFormatMarkdown)
+}
+
+// formatMarkdownAnalysis turns the analysis into a PR comment: a header with the failed step and the
+// failure class, the "Likely cause" and "Suggested fix" sections of the analysis, and the end of the
+// failed step's logs in a collapsed <details> block.
+func formatMarkdownAnalysis(analysis, logs string) string {
+	var md strings.Builder
+	md.WriteString("## 🔴 Build failure analysis\n\n")
+
+	failedStepTitle := ""
+	if failedSteps := failedStepsFromEnv(); len(failedSteps) > 0 {
+		failedStepTitle = failedSteps[0].Title
+	}
+	var facts []string
+	if buildNumber := getInput("BITRISE_BUILD_NUMBER"); buildNumber != "" {
+		facts = append(facts, fmt.Sprintf("**Build:** #%s", buildNumber))
+	}
+	if failedStepTitle != "" {
+		facts = append(facts, fmt.Sprintf("**Failed step:** %s", markdownCode(failedStepTitle)))
+	}
+	if failureClass != "" {
+		facts = append(facts, fmt.Sprintf("**Failure class:** %s", failureClass))
+	}
+	if logCompleteness != logCompletenessFinishedArchived && logCompleteness != logCompletenessInputFile {
+		facts = append(facts, fmt.Sprintf("**Logs:** partial (%s)", logCompleteness))
+	}
+	if len(facts) > 0 {
+		md.WriteString(strings.Join(facts, " · ") + "\n\n")
+	}
+
+	// The model may ignore the requested sections, its answer is then kept whole
+	analysis = strings.TrimSpace(analysis)
+	if !markdownSectionsPattern.MatchString(analysis) {
+		md.WriteString("### Analysis\n\n")
+	}
+	md.WriteString(analysis + "\n")
+
+	excerptTitle, excerpt := markdownExcerpt(logs)
+	if strings.TrimSpace(excerpt) != "" {
+		fence := markdownFence(excerpt)
+		md.WriteString("\n<details>\n")
+		md.WriteString(fmt.Sprintf("<summary>Log excerpt: %s</summary>\n\n", html.EscapeString(excerptTitle)))
+		md.WriteString(fence + "text\n" + strings.TrimRight(excerpt, "\n") + "\n" + fence + "\n\n")
+		md.WriteString("</details>\n")
+	}
+	return md.String()
+}
+
+// markdownExcerpt returns the title and the last lines of the failed step, or of the last step
+// when the failed step is not known or not in the logs
+func markdownExcerpt(logs string) (string, string) {
+	steps := analyzer.ParseSteps(logs)
+	if len(steps) == 0 {
+		return "", ""
+	}
+
+	excerptStep := steps[len(steps)-1]
+	failedSteps := failedStepsFromEnv()
+	for _, step := range steps {
+		if isReportedFailedStep(step.Title, failedSteps) {
+			excerptStep = step
+			break
+		}
+	}
+	return excerptStep.Title, analyzer.TailStepLines(excerptStep.Logs, markdownExcerptLines)
+}
+
+// markdownFence returns a code fence longer than any run of backticks in text, so the excerpt can't close it
+func markdownFence(text string) string {
+	longest, run := 0, 0
+	for _, r := range text {
+		if r == '`' {
+			run++
+			longest = maxInt(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	return strings.Repeat("`", maxInt(3, longest+1))
+}
+
+// markdownCode formats text as inline code
+func markdownCode(text string) string {
+	if strings.Contains(text, "`") {
+		return "`` " + text + " ``"
+	}
+	return "`" + text + "`"
+}
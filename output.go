@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
+)
+
+// OutputDocument is the structured form of the optimized logs, written when output_format is json
+type OutputDocument struct {
+	Steps           []OutputStep `json:"steps"`
+	FailedStepTitle string       `json:"failed_step_title,omitempty"`
+	// FailedStepGuessed is set when the failed step was guessed from the logs instead of reported by Bitrise
+	FailedStepGuessed bool   `json:"failed_step_guessed,omitempty"`
+	ErrorMessage      string `json:"error_message,omitempty"`
+	FailureClass      string `json:"failure_class"`
+	// LogCompleteness is "finished_archived" for a full log, otherwise the reason the log is partial
+	LogCompleteness string `json:"log_completeness"`
+	Truncated       bool   `json:"truncated"`
+	// MachineInfo describes the build machine when include_machine_info is enabled, e.g. {"Stack": "osx-xcode-15.0.x"}
+	MachineInfo map[string]string `json:"machine_info,omitempty"`
+}
+
+type OutputStep struct {
+	Title    string `json:"title"`
+	Type     string `json:"type,omitempty"`
+	ExitCode int    `json:"exit_code"`
+	Duration string `json:"duration,omitempty"`
+	Logs     string `json:"logs"`
+}
+
+// buildOutputDocument splits the optimized logs back into steps and describes them for programmatic consumption.
+// Like the text output, the logs are capped to the most recent maxBytes, 0 means no cap.
+func buildOutputDocument(optimizedLogs string, maxBytes int) OutputDocument {
+	patterns := getInput("step_log_filter_patterns")
+	optimizedLogs = capOutputSize(optimizedLogs, maxBytes)
+
+	doc := OutputDocument{
+		FailedStepTitle: getInput("BITRISE_FAILED_STEP_TITLE"),
+		ErrorMessage:    getInput("BITRISE_FAILED_STEP_ERROR_MESSAGE"),
+		FailureClass:    failureClass,
+		LogCompleteness: logCompleteness,
+		Truncated:       strings.HasPrefix(optimizedLogs, analyzer.TruncationNotePrefix),
+		Steps:           []OutputStep{},
+	}
+	if doc.FailedStepTitle == "" {
+		doc.FailedStepTitle, doc.FailedStepGuessed = detectedFailedStep()
+	}
+	if len(machineInfo) > 0 {
+		doc.MachineInfo = map[string]string{}
+		for _, field := range machineInfo {
+			doc.MachineInfo[field.Name] = field.Value
+		}
+	}
+
+	for _, step := range analyzer.ParseSteps(optimizedLogs) {
+		doc.Steps = append(doc.Steps, OutputStep{
+			Title:    step.Title,
+			Type:     stepTypeOf(step.Title, patterns),
+			ExitCode: step.ExitCode,
+			Duration: step.Duration,
+			Logs:     step.Logs,
+		})
+	}
+
+	return doc
+}
+
+// writeJSONOutput writes the document to the output file, or to stdout when no file is set.
+func writeJSONOutput(filePath string, doc OutputDocument) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeLogFile(filePath, string(data)+"\n")
+}
+
+// stdoutOutputFile as output_file writes the logs to stdout, see stdoutOutput
+const stdoutOutputFile = "-"
+
+// stdoutOutput is set by output_file=- or output_to_stdout, the logs are then the only thing printed to stdout,
+// between the BEGIN/END markers, and the diagnostics go to stderr, so the step can be piped into other commands
+var stdoutOutput bool
+
+// writeStdoutBlock prints content to stdout between "=== BEGIN AI ANALYZER <label> ===" and
+// "=== END AI ANALYZER <label> ===" lines
+func writeStdoutBlock(label, content string) error {
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	_, err := fmt.Printf("=== BEGIN AI ANALYZER %s ===\n%s=== END AI ANALYZER %s ===\n", label, content, label)
+	return err
+}
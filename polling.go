@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// poll_strategy values: the interval input between all polls, or an interval adapting to the log output
+const (
+	pollStrategyFixed    = "fixed"
+	pollStrategyAdaptive = "adaptive"
+)
+
+// defaultMaxPollInterval caps the adaptive interval of builds staying silent for a long time
+const defaultMaxPollInterval = 60 * time.Second
+
+// pollScheduler decides the wait before the next poll. The adaptive strategy starts at minPollInterval,
+// doubles the interval after each poll without new chunks up to maxInterval, and halves it while chunks
+// keep arriving, so long quiet phases (e.g. compiling, running tests) cost few API calls.
+type pollScheduler struct {
+	adaptive    bool
+	interval    time.Duration
+	maxInterval time.Duration
+}
+
+// newPollScheduler validates the poll_strategy value, unknown strategies are logged and poll at the fixed interval
+func newPollScheduler(strategy string, interval, maxInterval time.Duration) *pollScheduler {
+	switch strings.ToLower(strings.TrimSpace(strategy)) {
+	case "", pollStrategyFixed:
+		return &pollScheduler{interval: interval}
+	case pollStrategyAdaptive:
+		if maxInterval < minPollInterval {
+			maxInterval = defaultMaxPollInterval
+		}
+		return &pollScheduler{adaptive: true, interval: minPollInterval, maxInterval: maxInterval}
+	default:
+		logWarnf("⚠️  Warning: unknown poll_strategy %q, using %s\n", strategy, pollStrategyFixed)
+		return &pollScheduler{interval: interval}
+	}
+}
+
+// next returns the wait before the next poll, given the chunks the last poll brought
+func (s *pollScheduler) next(newChunks int) time.Duration {
+	if !s.adaptive {
+		return s.interval
+	}
+
+	if newChunks > 0 {
+		s.interval /= 2
+	} else {
+		s.interval *= 2
+	}
+	if s.interval < minPollInterval {
+		s.interval = minPollInterval
+	}
+	if s.interval > s.maxInterval {
+		s.interval = s.maxInterval
+	}
+	logVerbosef("Next poll in %s (adaptive)\n", s.interval)
+	return s.interval
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
+)
+
+// Sink receives the collected logs chunk by chunk, see newOutputSink. Sinks buffering the chunks also
+// implement Flush, called once per poll so a killed step still leaves the logs of the previous polls behind.
+type Sink interface {
+	Write(chunk string) error
+	// Close flushes and closes the sink. The next Write opens it again, e.g. after the file was replaced with writeLogFile.
+	Close() error
+}
+
+// flushSink writes the chunks buffered by the sink, when it buffers them
+func flushSink(sink Sink) error {
+	if flusher, ok := sink.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// newOutputSink returns the sink appending to the file: gzip compressed for .gz paths, stdout without a path
+func newOutputSink(path string) Sink {
+	return newOutputSinkMode(path, fileSinkAppend)
+}
+
+// newOutputSinkMode is newOutputSink with the file written in the given mode
+func newOutputSinkMode(path string, mode fileSinkMode) Sink {
+	switch {
+	case path == "":
+		return StdoutSink{}
+	case isGzipPath(path):
+		return NewGzipSink(newFileSinkMode(path, mode))
+	default:
+		return newFileSinkMode(path, mode)
+	}
+}
+
+// fileSinkMode tells what a FileSink does with the previous content of its file
+type fileSinkMode int
+
+const (
+	// fileSinkAppend appends the chunks to the file
+	fileSinkAppend fileSinkMode = iota
+	// fileSinkReplace truncates the file on the first write, the later writes append to it
+	fileSinkReplace
+	// fileSinkAtomic writes the chunks to <path>.tmp, renamed to the file on Close so it is never
+	// left half written. Atomic sinks are not written after Close.
+	fileSinkAtomic
+)
+
+// FileSink keeps a file open for the whole collection and buffers the appended chunks,
+// instead of opening and closing the file for every chunk
+type FileSink struct {
+	path   string
+	file   *os.File
+	buffer *bufio.Writer
+	mode   fileSinkMode
+	// opened is set by the first write, so a file reopened after Close is appended to
+	opened bool
+}
+
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+func newFileSinkMode(path string, mode fileSinkMode) *FileSink {
+	return &FileSink{path: path, mode: mode}
+}
+
+// writePath is the file the chunks are written to, the temporary file of atomic sinks
+func (s *FileSink) writePath() string {
+	if s.mode == fileSinkAtomic {
+		return s.path + ".tmp"
+	}
+	return s.path
+}
+
+// Write buffers the chunk, opening the file on first use
+func (s *FileSink) Write(chunk string) error {
+	if s.file == nil {
+		flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+		if !s.opened && s.mode != fileSinkAppend {
+			flags |= os.O_TRUNC
+		}
+		file, err := os.OpenFile(s.writePath(), flags, 0644)
+		if err != nil {
+			return err
+		}
+		s.file = file
+		s.buffer = bufio.NewWriter(file)
+		s.opened = true
+	}
+	_, err := s.buffer.WriteString(chunk)
+	return err
+}
+
+// Flush writes the buffered chunks to the file
+func (s *FileSink) Flush() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.buffer.Flush()
+}
+
+// Close closes the file, atomic sinks then move the temporary file to the path
+func (s *FileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	flushErr := s.Flush()
+	closeErr := s.file.Close()
+	s.file, s.buffer = nil, nil
+	if flushErr != nil {
+		return flushErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if s.mode == fileSinkAtomic {
+		return os.Rename(s.writePath(), s.path)
+	}
+	return nil
+}
+
+// GzipSink appends the chunks gzip compressed to a file. Each Flush ends a gzip member,
+// concatenated members form a valid gzip file even when the step is killed before Close.
+type GzipSink struct {
+	file *FileSink
+	gzip *gzip.Writer
+}
+
+// NewGzipSink compresses the chunks into file, whose mode tells whether the file is appended to or replaced
+func NewGzipSink(file *FileSink) *GzipSink {
+	return &GzipSink{file: file}
+}
+
+func (s *GzipSink) Write(chunk string) error {
+	if s.gzip == nil {
+		s.gzip = gzip.NewWriter(sinkWriter{s.file})
+	}
+	_, err := io.WriteString(s.gzip, chunk)
+	return err
+}
+
+func (s *GzipSink) Flush() error {
+	if s.gzip != nil {
+		if err := s.gzip.Close(); err != nil {
+			return err
+		}
+		s.gzip = nil
+	}
+	return s.file.Flush()
+}
+
+func (s *GzipSink) Close() error {
+	flushErr := s.Flush()
+	closeErr := s.file.Close()
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
+
+// sinkWriter writes the bytes written to it to the sink, for writers like gzip.Writer
+type sinkWriter struct {
+	sink Sink
+}
+
+func (w sinkWriter) Write(p []byte) (int, error) {
+	if err := w.sink.Write(string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// StdoutSink prints the chunks to stdout
+type StdoutSink struct{}
+
+func (StdoutSink) Write(chunk string) error {
+	_, err := fmt.Print(chunk)
+	return err
+}
+
+func (StdoutSink) Close() error {
+	return nil
+}
+
+// MultiSink writes every chunk to all of its sinks, e.g. to several output files. An empty MultiSink discards the chunks.
+type MultiSink []Sink
+
+// Write writes the chunk to every sink, even when an earlier one fails, and returns the first error
+func (m MultiSink) Write(chunk string) error {
+	var firstErr error
+	for _, sink := range m {
+		if err := sink.Write(chunk); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m MultiSink) Flush() error {
+	var firstErr error
+	for _, sink := range m {
+		if err := flushSink(sink); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m MultiSink) Close() error {
+	var firstErr error
+	for _, sink := range m {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// CappedSink keeps the file of sink under maxBytes: once the chunks would exceed it, they are only kept
+// in memory and the file is rewritten with the most recent maxBytes of logs on Flush and Close,
+// so a long build costs one rewrite per poll instead of one per chunk.
+type CappedSink struct {
+	sink     Sink
+	path     string
+	maxBytes int
+	// tail is the content of the file, kept to rewrite it once maxBytes is reached
+	tail    string
+	trimmed bool
+	// dirty is set when tail holds chunks not written to the file yet
+	dirty bool
+}
+
+func NewCappedSink(path string, maxBytes int) *CappedSink {
+	return &CappedSink{sink: newOutputSinkMode(path, fileSinkReplace), path: path, maxBytes: maxBytes}
+}
+
+func (s *CappedSink) Write(chunk string) error {
+	if len(s.tail)+len(chunk) <= s.maxBytes {
+		s.tail += chunk
+		return s.sink.Write(chunk)
+	}
+
+	if !s.trimmed {
+		logWarnf("⚠️  Warning: output file reached max_output_bytes (%d), keeping only the most recent logs\n", s.maxBytes)
+		s.trimmed = true
+		if err := s.sink.Close(); err != nil {
+			return err
+		}
+	}
+	s.tail += chunk
+	s.dirty = true
+	// The tail is trimmed once it doubled, not on every chunk
+	if len(s.tail) > 2*s.maxBytes {
+		s.tail = analyzer.TailOfText(s.tail, s.maxBytes)
+	}
+	return nil
+}
+
+// Flush rewrites the file with the most recent logs once maxBytes was reached
+func (s *CappedSink) Flush() error {
+	if !s.trimmed {
+		return flushSink(s.sink)
+	}
+	if !s.dirty {
+		return nil
+	}
+	s.tail = analyzer.TailOfText(s.tail, s.maxBytes)
+	if err := writeLogFile(s.path, s.tail); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *CappedSink) Close() error {
+	if s.trimmed {
+		return s.Flush()
+	}
+	return s.sink.Close()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
+)
+
+// Log completeness values exported in AI_ANALYZER_LOG_COMPLETENESS, anything but finished_archived is a partial log
+const (
+	logCompletenessFinishedArchived  = "finished_archived"
+	logCompletenessStoppedAtSentinel = "stopped_at_sentinel"
+	logCompletenessTimedOut          = "timed_out"
+	logCompletenessCancelled         = "cancelled"
+	// logCompletenessStoppedAtFirstError is used when fast_mode stopped the collection after the first error
+	logCompletenessStoppedAtFirstError = "stopped_at_first_error"
+	// logCompletenessInputFile is used for logs read from input_log_file, whose completeness isn't known
+	logCompletenessInputFile = "input_file"
+	// logCompletenessArtifact is used for logs read from the artifact_name build artifact, uploaded by a step of the build
+	logCompletenessArtifact = "artifact"
+)
+
+// logCompleteness tells whether the collected log is the full build log, set when collecting it
+var logCompleteness = logCompletenessTimedOut
+
+// collectionStats counts what a run collected and kept, printed at the end to help tune the filter patterns
+type collectionStats struct {
+	polls          int
+	chunksFetched  int
+	source         string
+	collectedBytes int
+	// receivedBytes is the size of the raw logs, when the streaming parser only kept the filtered steps
+	receivedBytes  int
+	optimizedBytes int
+	collectedLines int
+	optimizedLines int
+	stepsParsed    int
+	failedSteps    []string
+	startTime      time.Time
+	// buildStatus is the last state of the build, see fetchBuildStatus, empty when it wasn't checked
+	buildStatus string
+}
+
+// recordLogs fills in the counters derived from the collected and optimized logs.
+func (s *collectionStats) recordLogs(collectedLogs, optimizedLogs string) {
+	s.collectedBytes = len(collectedLogs)
+	s.optimizedBytes = len(optimizedLogs)
+	s.collectedLines = countLines(collectedLogs)
+	s.optimizedLines = countLines(optimizedLogs)
+
+	steps := analyzer.ParseSteps(collectedLogs)
+	s.stepsParsed = len(steps)
+	reported := failedStepsFromEnv()
+	for _, step := range steps {
+		if isReportedFailedStep(step.Title, reported) || step.ExitCode != 0 {
+			s.failedSteps = append(s.failedSteps, step.Title)
+		}
+	}
+}
+
+func (s *collectionStats) print() {
+	failed := "none identified"
+	if len(s.failedSteps) > 0 {
+		failed = strings.Join(s.failedSteps, ", ")
+	}
+	source := s.source
+	if source == "" {
+		source = "log chunks"
+	}
+
+	logSummaryf("\n📊 Collection summary\n")
+	logSummaryf("  Source:          %s\n", source)
+	logSummaryf("  API polls:       %d\n", s.polls)
+	logSummaryf("  Chunks fetched:  %d\n", s.chunksFetched)
+	logSummaryf("  Completeness:    %s\n", logCompleteness)
+	if s.buildStatus != "" {
+		logSummaryf("  Build status:    %s\n", s.buildStatus)
+	}
+	if s.receivedBytes > s.collectedBytes {
+		logSummaryf("  Bytes received:  %d (steps filtered while collecting)\n", s.receivedBytes)
+	}
+	logSummaryf("  Bytes collected: %d (%d after optimization)\n", s.collectedBytes, s.optimizedBytes)
+	logSummaryf("  Lines kept:      %d of %d\n", s.optimizedLines, s.collectedLines)
+	logSummaryf("  Steps parsed:    %d\n", s.stepsParsed)
+	if redactedSecrets > 0 {
+		logSummaryf("  Secrets redacted: %d\n", redactedSecrets)
+	}
+	logSummaryf("  Failed step:     %s\n", failed)
+	logSummaryf("  Elapsed:         %s\n", time.Since(s.startTime).Round(time.Millisecond))
+}
+
+// countLines counts the lines of text, a trailing newline doesn't start a new line.
+func countLines(text string) int {
+	if text == "" {
+		return 0
+	}
+	return strings.Count(strings.TrimSuffix(text, "\n"), "\n") + 1
+}
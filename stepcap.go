@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
+)
+
+// capSteps keeps the maxSteps most relevant steps of the logs, in build order. The failed steps come first,
+// then the steps which exited with a non-zero code, then the steps with the most failure keywords (see
+// failureIndicatorPattern), later steps winning ties. The dropped steps are listed in a note at the top.
+func capSteps(logs string, maxSteps int) string {
+	steps := analyzer.ParseSteps(logs)
+	if maxSteps <= 0 || len(steps) <= maxSteps {
+		return logs
+	}
+
+	type rankedStep struct {
+		index    int
+		failed   bool
+		exitCode bool
+		matches  int
+	}
+	failedSteps := failedStepsFromEnv()
+	ranked := make([]rankedStep, len(steps))
+	for i, step := range steps {
+		ranked[i] = rankedStep{
+			index:    i,
+			failed:   isReportedFailedStep(step.Title, failedSteps),
+			exitCode: step.ExitCode != 0,
+			matches:  len(failureIndicatorPattern.FindAllStringIndex(step.Logs, -1)),
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.failed != b.failed {
+			return a.failed
+		}
+		if a.exitCode != b.exitCode {
+			return a.exitCode
+		}
+		if a.matches != b.matches {
+			return a.matches > b.matches
+		}
+		return a.index > b.index
+	})
+
+	kept := make([]bool, len(steps))
+	for _, step := range ranked[:maxSteps] {
+		kept[step.index] = true
+	}
+
+	var keptLogs, droppedTitles []string
+	for i, step := range steps {
+		if kept[i] {
+			keptLogs = append(keptLogs, step.Logs)
+		} else {
+			droppedTitles = append(droppedTitles, step.Title)
+		}
+	}
+	logInfof("Keeping the %d most relevant of %d steps (max_steps), dropped: %s\n", maxSteps, len(steps), strings.Join(droppedTitles, ", "))
+
+	note := fmt.Sprintf("=== %d of %d steps omitted by max_steps: %s ===\n\n", len(droppedTitles), len(steps), strings.Join(droppedTitles, ", "))
+	return note + analyzer.JoinStepLogs(keptLogs)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+
+	"github.com/bitrise-io/bitrise-ai-workflows/log-fetcher-step/analyzer"
+)
+
+// logCollector accumulates the collected logs, either whole (strings.Builder) or filtered step by step
+type logCollector interface {
+	io.Writer
+	io.StringWriter
+	// Len is the number of bytes collected
+	Len() int
+	String() string
+}
+
+// streamingCollector filters each step as soon as it is parsed and only keeps the filtered steps,
+// so memory is bounded by the largest step instead of the whole log. The raw logs can be written
+// to rawFile on the way, a temporary file replacing the file once the logs are complete.
+type streamingCollector struct {
+	parser   *analyzer.StepParser
+	filter   *stepFilter
+	filtered []string
+	bytes    int
+	rawFile  Sink
+	// rawFileErr stops writing the raw logs after the first failure
+	rawFileErr error
+}
+
+func newStreamingCollector(rawFile string) *streamingCollector {
+	c := &streamingCollector{filter: newStepFilter()}
+	if rawFile != "" {
+		c.rawFile = newOutputSinkMode(rawFile, fileSinkAtomic)
+	}
+	c.parser = analyzer.NewStepParser(func(step analyzer.StepLogs) {
+		// The failed step may only be found in the complete logs, the filtered steps are annotated
+		// by optimizeLogsForAnalysis once it is known
+		step.Logs = analyzer.CollapseCarriageReturns(step.Logs)
+		if stepLogs, kept := c.filter.apply(step); kept {
+			c.filtered = append(c.filtered, stepLogs)
+		}
+	})
+	return c
+}
+
+func (c *streamingCollector) Write(p []byte) (int, error) {
+	return c.WriteString(string(p))
+}
+
+func (c *streamingCollector) WriteString(s string) (int, error) {
+	c.bytes += len(s)
+	c.parser.WriteString(s)
+
+	if c.rawFile != nil && c.rawFileErr == nil {
+		c.rawFileErr = c.rawFile.Write(s)
+		c.warnRawFileErr()
+	}
+	return len(s), nil
+}
+
+// flushRawFile writes the buffered raw logs to rawFile.
+func (c *streamingCollector) flushRawFile() {
+	if c.rawFile != nil && c.rawFileErr == nil {
+		c.rawFileErr = flushSink(c.rawFile)
+		c.warnRawFileErr()
+	}
+}
+
+func (c *streamingCollector) warnRawFileErr() {
+	if c.rawFileErr != nil {
+		logWarnf("⚠️  Warning: could not write raw logs: %v\n", c.rawFileErr)
+	}
+}
+
+func (c *streamingCollector) Len() int {
+	return c.bytes
+}
+
+// String hands over the last step and returns the filtered logs, no more logs can be written after it.
+func (c *streamingCollector) String() string {
+	c.parser.Close()
+	if c.rawFile != nil && c.rawFileErr == nil {
+		c.rawFileErr = c.rawFile.Close()
+		c.warnRawFileErr()
+	}
+	if currentLogLevel >= logLevelVerbose {
+		printStepSizes(c.filter.sizes)
+	}
+	return analyzer.JoinStepLogs(c.filtered)
+}